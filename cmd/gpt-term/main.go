@@ -1,34 +1,74 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/lipgloss/table"
 	"github.com/charmbracelet/x/term"
 	"github.com/google/uuid"
 
 	"flag"
+	"gpt-term/internal/appdir"
+	"gpt-term/internal/cache"
 	"gpt-term/internal/claude"
+	"gpt-term/internal/config"
+	"gpt-term/internal/explain"
+	"gpt-term/internal/keychain"
+	"gpt-term/internal/livecmd"
+	"gpt-term/internal/pager"
+	"gpt-term/internal/persona"
+	"gpt-term/internal/procgroup"
+	"gpt-term/internal/shellhistory"
 	"gpt-term/internal/storage"
 )
 
 // New message types for asynchronous commands
 
 type apiResponseMsg struct {
-	response string
-	err      error
+	response   string
+	stopReason string
+	usage      claude.Usage
+	err        error
+	stream     chan tea.Msg // The stream that produced the response, if any
+	cached     bool         // The response came from the cache, not the API
+}
+
+// recoveryTickMsg triggers a write of the recovery file
+type recoveryTickMsg struct{}
+
+// retryMsg reports that a request failed and will be retried after a wait
+type retryMsg struct {
+	info   claude.RetryInfo
+	stream chan tea.Msg
+}
+
+// streamChunkMsg carries a piece of a response as it's streamed in
+type streamChunkMsg struct {
+	text     string
+	thinking bool // text is part of the model's reasoning rather than its answer
+	stream   chan tea.Msg
 }
 
 type editMessageMsg struct {
@@ -39,8 +79,60 @@ type editMessageMsg struct {
 
 // Add new message type for command output
 type commandOutputMsg struct {
-	output string
-	err    error
+	output  string
+	err     error
+	command string // The command that ran
+	raw     string // Its output exactly as captured
+
+	exitCode  int  // -1 if it was killed or couldn't start
+	truncated bool // The command was killed for producing too much output
+}
+
+// liveTickMsg checks on the live command, see feedLive
+type liveTickMsg struct {
+	live *livecmd.Command
+}
+
+// toastExpiredMsg dismisses the toast with id if it's still showing
+type toastExpiredMsg struct {
+	id int
+}
+
+// pathOpenedMsg reports whether opening a path from a message worked
+type pathOpenedMsg struct {
+	path string
+	err  error
+}
+
+// copiedMsg reports whether copying what to the clipboard worked
+type copiedMsg struct {
+	what string
+	err  error
+}
+
+// pipedMsg reports whether pipe_command took the conversation
+type pipedMsg struct {
+	err error
+}
+
+// clipboardMsg carries the contents of the system clipboard
+type clipboardMsg struct {
+	text string
+	err  error
+}
+
+// explanationMsg carries the model's explanation of a command
+type explanationMsg struct {
+	command string
+	text    string
+	err     error
+}
+
+type summaryMsg struct {
+	conv    *storage.Conversation
+	summary string
+	err     error
+	fresh   bool // Asked for with Alt+T, replaces the current summary
 }
 
 // Add new message type for scrolling
@@ -51,25 +143,111 @@ type scrollMsg struct {
 // model now includes spinner and loading flag
 
 type model struct {
-	textInput       textinput.Model
-	viewport        viewport.Model
-	err             error
-	conversation    *storage.Conversation
-	mode            Mode
-	messages        []storage.Message
-	cursorIndex     int
-	storage         *storage.Storage
-	client          *claude.Client
-	conversations   []storage.Conversation
-	selectedConv    int
-	spinner         spinner.Model
-	isLoading       bool
-	height          int
-	width           int
-	commands        [][]string
-	selectedCommand int
-	ready           bool // Add this field to track if window size is set
-	lastLoadedConv  int  // Add this new field
+	textInput        textinput.Model
+	viewport         viewport.Model
+	err              error
+	conversation     *storage.Conversation
+	mode             Mode
+	messages         []storage.Message
+	cursorIndex      int
+	storage          *storage.Storage
+	client           *claude.Client
+	fallbackClient   *claude.Client // Uses the fallback model, nil when none is configured
+	fallbackReason   string         // Why the last request failed, while it can be retried with the fallback model
+	config           *config.Config
+	cache            *cache.Cache // Set with --cache to reuse answers to identical requests
+	conversations    []storage.Conversation
+	selectedConv     int
+	spinner          spinner.Model
+	isLoading        bool
+	height           int
+	width            int
+	commands         []command
+	commandSource    int // Index of the message the commands were taken from
+	selectedCommand  int
+	ready            bool                  // Add this field to track if window size is set
+	lastLoadedConv   int                   // Add this new field
+	lastClickIndex   int                   // List item hit by the last mouse click
+	lastClickTime    time.Time             // When it was clicked, for double click detection
+	streamCh         chan tea.Msg          // Stream of the response in flight
+	streamCancel     context.CancelFunc    // Gives up on it, e.g. while it's waiting to retry
+	retry            *claude.RetryInfo     // Set while waiting to retry a failed request
+	retryAt          time.Time             // When the retry will be sent
+	streamConv       *storage.Conversation // Conversation the response belongs to
+	streamIndex      int                   // Message the response is streamed into
+	stopping         bool                  // The user stopped the response streaming in, so its text is kept
+	showSystem       bool                  // Show the system prompt inline in the normal view
+	lastCommand      string                // Last command run from the app
+	lastOutput       string                // Its raw output
+	lastExitCode     int                   // Its exit status, -1 if it was killed or couldn't start
+	lastTruncated    bool                  // Its output was cut off at max_output_mb
+	promptInput      textinput.Model       // Input for one-off questions like a file name
+	promptLabel      string
+	promptAction     promptAction
+	promptReturn     Mode   // The mode to go back to when the prompt closes
+	exportText       string // Message text waiting for a file name to be saved to
+	searchQuery      string
+	previousConvID   string // The conversation open before the current one
+	switchedFrom     string // Summary of the conversation Alt+L just left, shown in the title bar
+	toast            string // Short feedback shown under the conversation for a couple of seconds
+	toastIsError     bool
+	toastID          int                    // Counts toasts so an old one's timer doesn't dismiss a newer one
+	lastRecovery     string                 // The last state written to the recovery file
+	recovered        []storage.Conversation // Unsaved conversations left by a session that was killed
+	recoveryPath     string
+	pendingEdit      *editMessageMsg // An edit waiting for confirmation because it discards later messages
+	outputLines      []string        // Lines of the last command output while picking some to attach
+	outputCursor     int
+	outputAnchor     int                             // Where the selection started, -1 when nothing is being selected
+	searchResults    map[string]storage.SearchResult // History search hits, keyed by conversation ID
+	notice           string                          // Feedback on the last action, cleared by the next key press
+	showExplanation  bool
+	following        bool                // Keep the view at the bottom as new output arrives
+	newBelow         bool                // Something arrived below the view while not following
+	explanations     map[string]string   // Explanations of commands, keyed by command text
+	summarizing      map[string]bool     // Conversations the model is writing a summary for, by ID
+	plainMessages    map[messageKey]bool // Assistant messages shown as raw text
+	attachment       string              // Context sent along with the next prompt
+	attachmentName   string              // What the attachment is, e.g. "Clipboard"
+	stats            stats               // Shown with Alt+S
+	macro            []string            // Actions of the running macro still to do
+	paths            []string            // Paths offered by the open path prompt
+	staged           bool                // Enter was pressed once with confirm_send on, the next one sends
+	macroWaiting     bool                // The macro waits for a response or command to finish
+	debug            bool                // --debug was passed, Alt+Q shows the API request
+	debugRequest     string              // The API request shown in debug mode
+	debugSent        bool                // Whether debugRequest was sent or is only what would be
+	pager            pager.Pager         // Scrolling and search for help, stats, the debug request and output
+	pagerMode        Mode                // The mode whose text the pager holds, to start it from the top in a new one
+	lastRun          *command            // The last command executed, run again with Alt+R
+	filling          *command            // Command whose placeholders are being filled in before it runs
+	fillingLive      bool                // Filled in to run live with L
+	fillQueue        []string            // Its placeholders still to fill in
+	live             *livecmd.Command    // Command whose output is fed to the model as it runs
+	liveConv         string              // Conversation the live command's output goes to
+	liveFed          time.Time           // When its output was last sent
+	codeBlock        bool                // Send the next prompt wrapped in a code block, toggled with Alt+C
+	flaggedOnly      bool                // Only show flagged messages, toggled with Alt+F
+	scrollToEnd      bool                // Scroll to the bottom once the window size is known
+	showThinking     map[messageKey]bool // Responses whose thinking is expanded
+	expanded         map[messageKey]bool // Long responses expanded with E in edit mode
+	selectedTemplate int
+}
+
+// messageKey identifies a message in a conversation for session-only state
+type messageKey struct {
+	conv  string
+	index int
+}
+
+// command is a runnable snippet extracted from an assistant message
+type command struct {
+	text string
+	// from says where a command the model didn't tag was found, e.g.
+	// "code block", and is empty for <command> tagged ones
+	from string
+	// filled is set once its placeholders were filled in, so it runs as is
+	filled bool
 }
 
 type Mode int
@@ -80,8 +258,39 @@ const (
 	ModeHistory
 	ModeCommandSelect
 	ModeHelp
+	ModePrompt
+	ModeTemplateSelect
+	ModeOutputSelect
+	ModeStats
+	ModeDebug
+	ModeOutput
+)
+
+// promptAction is what a line typed into the prompt input is used for
+type promptAction int
+
+const (
+	promptSaveOutput promptAction = iota
+	promptRename
+	promptSearch
+	promptRecover
+	promptConfirmEdit
+	promptWorkDir
+	promptDivider
+	promptOpenPath
+	promptPlaceholder
+	promptSettings
+	promptStopForNew
+	promptSaveMessage
+	promptGoto
+	promptPagerSearch
+	promptContextFile
 )
 
+// dividerRole marks messages that only divide a conversation into sections.
+// They're never sent to the API.
+const dividerRole = "divider"
+
 var (
 	focusedStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 	botStyle      = lipgloss.NewStyle().Foreground(lipgloss.Color("255"))
@@ -129,8 +338,56 @@ var (
 				Background(lipgloss.Color("226")). // Yellow bg
 				PaddingLeft(1).                    // Small padding
 				PaddingRight(1)                    // Small padding
+	sandboxStyle = lipgloss.NewStyle().
+			Background(lipgloss.Color("33")).  // Blue bg
+			Foreground(lipgloss.Color("255")). // White text
+			Padding(0, 1)
+	liveStyle = lipgloss.NewStyle().
+			Background(lipgloss.Color("160")). // Red bg
+			Foreground(lipgloss.Color("255")). // White text
+			Padding(0, 1)
+	blockedStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("196")) // Red text
+	pathStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("117")).Underline(true)
+	pathNumberStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("244"))
+
+	commandNumberStyle = lipgloss.NewStyle().
+				Background(lipgloss.Color("28")). // Darker green bg
+				Foreground(lipgloss.Color("255")).
+				Padding(0, 1)
+	hintKeyStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("82")).Bold(true)
+	followingStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("82"))
+	searchMatchStyle = lipgloss.NewStyle().Background(lipgloss.Color("226")).Foreground(lipgloss.Color("0"))
+	tableHeaderStyle = lipgloss.NewStyle().Bold(true).Padding(0, 1)
+	tableCellStyle   = lipgloss.NewStyle().Padding(0, 1)
+	thinkingStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("239")).Italic(true)
+	hintDescStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("245"))
+	lineNumberStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+	diffRemovedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
+	diffAddedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("82"))
+	discardedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241")).Strikethrough(true)
+	flaggedStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("226"))
+	dividerStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("244"))
+	toastStyle       = lipgloss.NewStyle().Background(lipgloss.Color("28")).Foreground(lipgloss.Color("255")).Padding(0, 1)
+	toastErrorStyle  = lipgloss.NewStyle().Background(lipgloss.Color("196")).Foreground(lipgloss.Color("255")).Padding(0, 1)
 )
 
+// applyTheme sets the role colors the config overrides
+func applyTheme(theme config.Theme) {
+	set := func(style *lipgloss.Style, background, foreground string) {
+		if background != "" {
+			*style = style.Background(lipgloss.Color(background))
+		}
+		if foreground != "" {
+			*style = style.Foreground(lipgloss.Color(foreground))
+		}
+	}
+	set(&userLabelStyle, theme.UserLabel, theme.UserLabelText)
+	set(&messageStyle, "", theme.UserText)
+	set(&assistantLabelStyle, theme.AssistantLabel, theme.AssistantLabelText)
+	set(&botStyle, "", theme.AssistantText)
+	set(&systemStyle, "", theme.SystemText)
+}
+
 const (
 	upArrow   = "▲"
 	downArrow = "▼"
@@ -138,22 +395,76 @@ const (
 	version   = "1.0.0"
 )
 
-const systemPrompt = `You are a bash terminal helper AI. Unless the user asks otherwise, you will specify all solutions in bash commands ideally one liners if its simple. Before displaying the bash command code, you must surround it with <command></command> tags. Each <command> block must contain exactly one command - if you need to show multiple commands, use multiple <command> blocks. Do not insert `
+const (
+	historyTitle        = "Conversation History (Press ESC to exit)\n\n"
+	commandOutputPrefix = "```\nCommand ran: " // How the output of a command starts in the conversation
+	outputSelectTitle   = "Pick the output lines to send with your next prompt:\n\n"
+	doubleClickInterval = 400 * time.Millisecond
+	recoveryInterval    = 5 * time.Second
+	commandShell        = "sh" // Suggested commands run with "sh -c" unless the persona has its own shell
+	toastDuration       = 2500 * time.Millisecond
+	collapsedLines      = 5    // Lines of a collapsed response that are still shown
+	liveChunkBytes      = 4000 // Most of a live command's output sent at once, the rest is left out
+)
+
+const systemPrompt = `You are a bash terminal helper AI. Unless the user asks otherwise, you will specify all solutions in bash commands ideally one liners if its simple. Before displaying the bash command code, you must surround it with <command></command> tags. Each <command> block must contain exactly one command - if you need to show multiple commands, use multiple <command> blocks. If a command itself contains the text </command>, write it as &lt;/command&gt; inside the block. Do not insert `
 
 const helpMessage = `GPT Terminal Help:
 - Ctrl+J/K: Enter edit mode and navigate through messages
 - Enter: Edit selected user message
 - X: Execute command from selected assistant message
-- Alt+X: Execute command from last assistant message
-- Ctrl+R: Browse conversation history
+- C: Copy selected message (in edit mode)
+- W: Save the selected message to a file, Shift+W without command tags and code fences (in edit mode)
+- S: Edit this conversation's system prompt (in edit mode)
+- M: Show the selected response as raw text or formatted (in edit mode)
+- T: Expand or collapse the model's reasoning for the selected response (in edit mode)
+- E: Expand or collapse a long response (in edit mode)
+- F: Flag the selected message as important, or unflag it (in edit mode)
+- Ctrl+X: Execute command from last assistant message (? explains the selected command)
+- Alt+X: Run the only command of the last response right away (needs auto_execute in the config)
+- O: Copy the selected command joined into one line (in the selection, C copies it as it is)
+- L: Run the selected command live, sending its output to the model as it runs (in the selection, needs live_feed_seconds in the config)
+- Ctrl+R: Browse conversation history (/ searches, D duplicates the selected conversation, L makes it read-only or unlocks it, T switches between full, relative and date-only timestamps, Ctrl+R again refreshes the list)
 - Ctrl+L: Load latest conversation
-- Ctrl+N: Create new chat
+- Alt+L: Switch back to the previous conversation
+- Alt+D: Set the directory this conversation's commands run in
+- Ctrl+N: Create new chat (pick a persona or one of your templates, Alt+L goes back)
+- Ctrl+G: Continue a response that was cut off
+- Alt+G: Go to a message by number (the numbers are shown while asking)
+- Ctrl+F: Retry a failed request with the fallback model (needs fallback_model in the config)
+- Ctrl+S: Save the output of the last command to a file
+- Ctrl+O: Show or hide the system prompt
+- Ctrl+Y: Copy all the commands from the last response
+- Alt+Y: Copy the path of this conversation's file
+- Alt+W: Send this conversation to your own tool as markdown or JSON (needs pipe_command in the config)
+- Alt+I: Start a new chat with a file, e.g. a project's README, as context
+- Alt+U: Show only the conversation and input, e.g. for recordings, or everything again
+- Alt+B: Copy the last command, its output and exit status as a fenced transcript, e.g. for a bug report
+- Alt+V: Read through the last command's whole output (/ searches, 12g jumps to line 12, Ctrl+D/Ctrl+U scroll half a page, also in help and stats)
+- Alt+O: Pick lines of the last command's output to send with your next prompt
+- Ctrl+T: Rename the current conversation
+- Alt+N: Write notes about this conversation in your editor (only for you, never sent)
+- Alt+T: Have the model write a new summary of the conversation as it is now
+- Alt+H: Attach your recent shell commands to your next prompt (needs shell_history in the config)
+- Alt+C: Send your next prompt as a code block
+- Alt+R: Run the last command again
+- Alt+A: Turn auto-scrolling to new messages on or off
+- Alt+F: Show only flagged messages, or all of them again
+- Alt+-: Add a divider to mark a new phase of your work (D removes the selected one in edit mode)
+- Alt+M: Set the model, max tokens and temperature of this conversation
+- Alt+S: Show stats across all your conversations
+- Alt+E: Ask the model to explain the last command's output and point out problems
+- Alt+P: Open a file path from the latest response in your editor (O opens one from the selected message in edit mode)
+- Keys bound to macros in the config run their actions in order (Esc stops them)
+- Ctrl+P: Attach the clipboard to your next prompt (press again to remove it)
+- Ctrl+U: Clear the input
+- Esc: Stop a response, clear the input, or leave the current mode (Esc never quits)
 - Ctrl+C: Quit
 - Ctrl+H: Show this help
 
-Commands in responses are highlighted and can be executed. If multiple commands are present, you'll be prompted to choose one.`
+Commands in responses are highlighted and can be executed. If multiple commands are present, you'll be prompted to choose one. Placeholders like <filename> or YOUR_IP are filled in before a command runs.`
 
-func initialModel() (model, error) {
+func initialModel(cfg *config.Config, apiKey string, respCache *cache.Cache) (model, error) {
 	ti := textinput.New()
 	ti.Placeholder = "What do you want to ask?"
 	ti.Focus()
@@ -164,12 +475,14 @@ func initialModel() (model, error) {
 		return model{}, fmt.Errorf("error creating storage: %w", err)
 	}
 
-	conv := &storage.Conversation{
-		ID:        uuid.New().String(),
-		CreatedAt: time.Now(),
-		Messages:  make([]storage.Message, 0),
+	// Pick up a prompt that was left unsent when the app last closed
+	if draft := store.LoadDraft(); draft != "" {
+		ti.SetValue(draft)
+		ti.CursorEnd()
 	}
 
+	conv := newConversation(config.Template{Persona: cfg.Persona})
+
 	sp := spinner.NewModel()
 	sp.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 	sp.Spinner = spinner.Points
@@ -177,29 +490,48 @@ func initialModel() (model, error) {
 	// Initialize viewport with default dimensions
 	vp := viewport.New(0, 0) // We'll set actual dimensions when we get WindowSizeMsg
 	vp.Style = lipgloss.NewStyle().Margin(1, 2)
+	if cfg.Compact {
+		vp.Style = lipgloss.NewStyle().Margin(0, 2)
+	}
 	vp.KeyMap = viewport.KeyMap{} // Clear default keybindings to avoid conflicts
 
-	// Add system prompt as hidden message
-	systemMsg := storage.Message{
-		Role:      "system",
-		Content:   systemPrompt,
-		Timestamp: time.Now(),
+	var fallbackClient *claude.Client
+	if cfg.FallbackModel != "" {
+		fallbackCfg := *cfg
+		fallbackCfg.Model = cfg.FallbackModel
+		fallbackClient = newClient(&fallbackCfg, apiKey)
 	}
-	conv.Messages = append(conv.Messages, systemMsg)
 
-	return model{
+	m := model{
 		textInput:      ti,
 		viewport:       vp,
 		mode:           ModeNormal,
 		conversation:   conv,
 		messages:       conv.Messages,
 		storage:        store,
-		client:         claude.NewClient(),
+		client:         newClient(cfg, apiKey),
+		fallbackClient: fallbackClient,
+		config:         cfg,
+		cache:          respCache,
 		spinner:        sp,
 		isLoading:      false,
 		ready:          false,
 		lastLoadedConv: -1, // Initialize to -1
-	}, nil
+		explanations:   make(map[string]string),
+		following:      cfg.AutoScroll,
+		plainMessages:  make(map[messageKey]bool),
+		summarizing:    make(map[string]bool),
+		showThinking:   make(map[messageKey]bool),
+		expanded:       make(map[messageKey]bool),
+	}
+
+	// Offer to bring back what a killed session hadn't saved
+	if path, convs, ok := store.FindRecovery(); ok {
+		m.recoveryPath = path
+		m.recovered = convs
+		m.startPrompt(fmt.Sprintf("gpt-term didn't exit cleanly last time. Recover %d unsaved conversation(s)? (y/n)", len(convs)), "y", promptRecover)
+	}
+	return m, nil
 }
 
 func (m model) Init() tea.Cmd {
@@ -211,10 +543,77 @@ func (m model) Init() tea.Cmd {
 		m.ready = true
 		m.updateViewport()
 	}
-	return textinput.Blink
+	return tea.Batch(textinput.Blink, recoveryTick())
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	prevMode := m.mode
+	prevToast := m.toastID
+	updated, cmd := m.update(msg)
+
+	// Go on with a macro once the response or command it waits for is done
+	if next, ok := updated.(model); ok && next.macroWaiting {
+		var failed, done bool
+		switch msg := msg.(type) {
+		case tea.KeyMsg:
+			// Esc stops the macro along with whatever it was doing
+			failed = msg.Type == tea.KeyEsc
+		case apiResponseMsg:
+			done = !next.isLoading
+			failed = msg.err != nil || next.canResume()
+		case commandOutputMsg:
+			done = true
+			failed = msg.err != nil
+		}
+		if failed {
+			next.macro = nil
+			next.macroWaiting = false
+			updated = next
+		} else if done {
+			next.macroWaiting = false
+			var stepCmd tea.Cmd
+			updated, stepCmd = next.nextMacroStep()
+			cmd = tea.Batch(cmd, stepCmd)
+		}
+	}
+
+	// Whatever arrived below has been seen once scrolled down to it
+	if next, ok := updated.(model); ok && next.newBelow && next.viewport.AtBottom() {
+		next.newBelow = false
+		updated = next
+	}
+
+	// Dismiss a new toast after a while, unless another replaced it by then
+	if next, ok := updated.(model); ok && next.toastID != prevToast {
+		id := next.toastID
+		cmd = tea.Batch(cmd, tea.Tick(toastDuration, func(time.Time) tea.Msg {
+			return toastExpiredMsg{id: id}
+		}))
+	}
+
+	// Mouse reporting is only turned on in the list modes, where clicks select
+	// items, so the terminal's own text selection keeps working elsewhere
+	if next, ok := updated.(model); ok && isListMode(prevMode) != isListMode(next.mode) {
+		if isListMode(next.mode) {
+			return next, tea.Batch(cmd, tea.EnableMouseCellMotion)
+		}
+		return next, tea.Batch(cmd, tea.DisableMouse)
+	}
+	return updated, cmd
+}
+
+// isListMode reports whether the mode shows a selectable list
+func isListMode(mode Mode) bool {
+	return mode == ModeHistory || mode == ModeCommandSelect
+}
+
+// isPagerMode reports whether mode shows a long text to read through with the
+// pager
+func isPagerMode(mode Mode) bool {
+	return mode == ModeHelp || mode == ModeStats || mode == ModeDebug || mode == ModeOutput
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
 	// Always update spinner if loading
@@ -231,7 +630,15 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.ready = true
 		// Update text input width to use full width (minus margins)
 		m.textInput.Width = m.width - 4 // Account for left and right margins
+		if m.config.Compact {
+			// Leave the rest of the line to the status
+			m.textInput.Width = m.width / 2
+		}
 		m.updateViewport()
+		if m.scrollToEnd {
+			m.viewport.GotoBottom()
+			m.scrollToEnd = false
+		}
 		return m, nil
 
 	case tea.MouseMsg:
@@ -248,6 +655,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.viewport.LineUp(3)
 			} else {
 				m.viewport.LineUp(3)
+				m.following = m.viewport.AtBottom()
 			}
 			return m, nil
 		case tea.MouseWheelDown:
@@ -262,14 +670,42 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.viewport.LineDown(3)
 			} else {
 				m.viewport.LineDown(3)
+				m.following = m.viewport.AtBottom()
+			}
+			return m, nil
+		case tea.MouseLeft:
+			// Click selects a list item, double click activates it like Enter
+			switch m.mode {
+			case ModeHistory:
+				if index, ok := m.conversationAtRow(msg.Y); ok {
+					m.selectedConv = index
+					if m.isDoubleClick(index) {
+						return m.update(tea.KeyMsg{Type: tea.KeyEnter})
+					}
+					m.ensureConversationVisible(m.selectedConv)
+				}
+			case ModeCommandSelect:
+				if index, ok := m.commandAtRow(msg.Y); ok {
+					m.selectedCommand = index
+					if m.isDoubleClick(index) {
+						return m.update(tea.KeyMsg{Type: tea.KeyEnter})
+					}
+					return m, m.explainSelected()
+				}
 			}
 			return m, nil
 		}
 
 	case tea.KeyMsg:
+		m.notice = ""
+		m.switchedFrom = ""
+
 		// First handle mode-independent keys
 		switch msg.String() {
 		case "ctrl+c":
+			if m.live != nil {
+				m.live.Stop()
+			}
 			return m, tea.Quit
 		case "ctrl+x":
 			return m.handleCommandExecution()
@@ -282,7 +718,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			// Load conversations
 			conversations, err := m.storage.ListConversations()
 			if err != nil {
-				m.err = err
+				m.fail(err)
 				return m, nil
 			}
 
@@ -299,98 +735,355 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}
 
 				// Load the next conversation
-				m.conversation = &conversations[m.lastLoadedConv]
-				m.messages = m.conversation.Messages
-				m.updateViewport()
-				m.viewport.GotoBottom()
+				m.openConversation(&conversations[m.lastLoadedConv])
 			}
 			return m, nil
 		case "ctrl+n":
-			// Create new conversation
-			conv := &storage.Conversation{
-				ID:        uuid.New().String(),
-				CreatedAt: time.Now(),
-				Messages:  make([]storage.Message, 0),
-			}
-			// Add system prompt as hidden message
-			systemMsg := storage.Message{
-				Role:      "system",
-				Content:   systemPrompt,
-				Timestamp: time.Now(),
-			}
-			conv.Messages = append(conv.Messages, systemMsg)
-
-			// Update model with new conversation
-			m.conversation = conv
-			m.messages = conv.Messages
-			m.mode = ModeNormal
-			m.updateViewport()
+			// Don't drop a response that's still coming in without asking
+			if m.isLoading {
+				return m, m.startPrompt("A response is still coming in. Stop it and start a new chat? (y/n)", "", promptStopForNew)
+			}
+			m.pickTemplate()
 			return m, nil
 		case "ctrl+h":
 			m.mode = ModeHelp
 			m.updateViewport()
 			return m, nil
+		case "ctrl+o":
+			m.showSystem = !m.showSystem
+			m.updateViewport()
+			return m, nil
 		}
 
 		// Then handle mode-specific keys
 		switch m.mode {
 		case ModeNormal:
-			// Handle viewport scrolling keys first
+			// Anything but a second Enter goes back to editing a staged prompt
+			if m.staged && msg.Type != tea.KeyEnter {
+				m.staged = false
+				m.updateViewport()
+			}
+
+			if actions, ok := m.config.Macros[msg.String()]; ok && !m.isLoading {
+				m.macro = append([]string(nil), actions...)
+				return m.nextMacroStep()
+			}
+
+			// Handle viewport scrolling keys first. Scrolling up stops
+			// following new output, getting back to the bottom resumes it.
 			switch msg.String() {
 			case "up":
 				m.viewport.LineUp(3)
+				m.following = m.viewport.AtBottom()
 				return m, nil // Return immediately to prevent updateViewport
 			case "down":
 				m.viewport.LineDown(3)
+				m.following = m.viewport.AtBottom()
 				return m, nil // Return immediately to prevent updateViewport
 			case "pgup":
 				m.viewport.HalfViewUp()
+				m.following = m.viewport.AtBottom()
 				return m, nil // Return immediately to prevent updateViewport
 			case "pgdn":
 				m.viewport.HalfViewDown()
+				m.following = m.viewport.AtBottom()
 				return m, nil // Return immediately to prevent updateViewport
 			case "home":
 				m.viewport.GotoTop()
+				m.following = m.viewport.AtBottom()
 				return m, nil // Return immediately to prevent updateViewport
 			case "end":
 				m.viewport.GotoBottom()
+				m.following = true
 				return m, nil // Return immediately to prevent updateViewport
 			}
 
 			// Then handle normal mode specific keys
 			switch msg.Type {
-			case tea.KeyEsc:
-				return m, tea.Quit
+			case tea.KeyEsc, tea.KeyCtrlU:
+				// Give up on a request that's waiting to be retried
+				if msg.Type == tea.KeyEsc && m.retry != nil {
+					m.streamCancel()
+					return m, nil
+				}
+				// Stop generating, keeping what has arrived so far
+				if msg.Type == tea.KeyEsc && m.isLoading {
+					m.stopping = true
+					m.streamCancel()
+					return m, nil
+				}
+				// Stop the live command once there's nothing typed to clear
+				if msg.Type == tea.KeyEsc && m.live != nil && m.textInput.Value() == "" {
+					m.live.Stop()
+					m.live = nil
+					m.showToast("Live command stopped", false)
+					return m, nil
+				}
+				// Discard the half-typed prompt; quitting is reserved for Ctrl+C
+				m.textInput.Reset()
+				return m, nil
 			case tea.KeyEnter:
-				if m.textInput.Value() != "" {
-					userMsg := storage.Message{
-						Role:      "user",
-						Content:   m.textInput.Value(),
-						Timestamp: time.Now(),
+				if m.textInput.Value() != "" && !m.isLoading {
+					if m.readOnly() {
+						return m, nil
 					}
-					m.messages = append(m.messages, userMsg)
-					m.conversation.Messages = m.messages
-					m.updateViewport()
-					m.viewport.GotoBottom()
-
-					var claudeMsgs []claude.Message
-					for _, msg := range m.messages {
-						claudeMsgs = append(claudeMsgs, claude.Message{
-							Role:    msg.Role,
-							Content: msg.Content,
-						})
+					if m.config.ConfirmSend && !m.staged {
+						// Show what would be sent and wait for another Enter
+						m.staged = true
+						m.notice = "Press Enter again to send, or keep typing"
+						m.updateViewport()
+						m.viewport.GotoBottom()
+						return m, nil
 					}
-
-					m.isLoading = true
+					m.staged = false
+					content := m.pendingPrompt()
+					m.codeBlock = false
+					m.attachment = ""
 					m.textInput.Reset()
-					return m, func() tea.Msg {
-						response, err := m.client.CreateMessage(claudeMsgs)
-						return apiResponseMsg{response: response, err: err}
+					if err := m.storage.SaveDraft(""); err != nil {
+						m.fail(err)
+					}
+					return m, m.send(content)
+				}
+			case tea.KeyCtrlS:
+				// Save the output of the last command to a file
+				if m.lastCommand != "" {
+					name := fmt.Sprintf("gpt-term-output-%s.txt", time.Now().Format("20060102-150405"))
+					return m, m.startPrompt("Save output to:", name, promptSaveOutput)
+				}
+				m.notice = "No command output to save yet"
+				return m, nil
+			case tea.KeyCtrlY:
+				// Copy just the commands of the last response, one per line
+				var commands []string
+				for i := len(m.messages) - 1; i >= 0; i-- {
+					if m.messages[i].Role == "assistant" {
+						for _, cmd := range extractCommands(m.messages[i].Content, m.config.InlineCommands) {
+							commands = append(commands, cmd.text)
+						}
+						break
 					}
 				}
+				if len(commands) == 0 {
+					m.notice = "The last response has no commands"
+					return m, nil
+				}
+				return m, copyToClipboard(strings.Join(commands, "\n")+"\n", fmt.Sprintf("%d command(s)", len(commands)))
+			case tea.KeyCtrlT:
+				// Rename the current conversation from the title bar
+				return m, m.startPrompt("Rename conversation:", m.conversation.Summary, promptRename)
+			case tea.KeyCtrlP:
+				// Attach the clipboard to the next prompt, or drop it again
+				if m.attachment != "" {
+					m.attachment = ""
+					m.notice = m.attachmentName + " removed"
+					return m, nil
+				}
+				return m, readClipboard()
+			case tea.KeyCtrlG:
+				// Pick up a response that was cut off where it left off
+				if m.canResume() && !m.readOnly() {
+					cmd := m.streamResponse()
+					m.updateViewport()
+					m.viewport.GotoBottom()
+					return m, cmd
+				}
+				return m, nil
+			case tea.KeyCtrlF:
+				// Send the failed request again with the fallback model
+				if m.canFallback() && !m.readOnly() {
+					cmd := m.streamWith(m.fallbackClient)
+					m.notice = "Retrying with " + m.fallbackClient.Model()
+					m.updateViewport()
+					m.viewport.GotoBottom()
+					return m, cmd
+				}
+				return m, nil
 			case tea.KeyRunes:
 				if msg.Alt {
 					switch msg.String() {
+					case "alt+h":
+						return m, m.attachShellHistory()
+					case "alt+x":
+						return m.autoExecute()
+					case "alt+l":
+						m.switchToPrevious()
+						return m, nil
+					case "alt+e":
+						// Ask what the latest command output means
+						command, ok := lastOutputCommand(m.messages)
+						if !ok {
+							m.notice = "No command output to explain yet"
+							return m, nil
+						}
+						if m.isLoading || m.readOnly() {
+							return m, nil
+						}
+						return m, m.send(explain.OutputPrompt(command))
+					case "alt+a":
+						// Choose whether new messages scroll the view down
+						m.config.AutoScroll = !m.config.AutoScroll
+						if err := config.SaveSetting("auto_scroll", m.config.AutoScroll); err != nil {
+							m.fail(err)
+						}
+						if m.config.AutoScroll {
+							m.showToast("Auto-scroll on", false)
+						} else {
+							m.showToast("Auto-scroll off, new messages won't move the view", false)
+						}
+						return m, nil
+					case "alt+r":
+						return m.rerun()
+					case "alt+y":
+						// Copy where the conversation is saved, e.g. to back it up
+						path := m.storage.ConversationPath(m.conversation)
+						if _, err := os.Stat(path); err != nil {
+							m.notice = "This conversation hasn't been saved yet"
+							return m, nil
+						}
+						return m, copyToClipboard(path, "conversation path")
+					case "alt+w":
+						return m, m.pipeConversation()
+					case "alt+t":
+						// Retitle the conversation after what it's about by now
+						if !hasUserMessage(m.conversation) {
+							m.notice = "Nothing to summarize yet"
+							return m, nil
+						}
+						if m.summarizing[m.conversation.ID] {
+							return m, nil
+						}
+						m.summarizing[m.conversation.ID] = true
+						m.notice = "Summarizing…"
+						return m, summarizeCmd(m.client, m.conversation, true)
+					case "alt+n":
+						// Write notes for yourself about this conversation, never sent
+						return m, editMessageCmd(m.editor(), m.conversation.Notes, notesIndex)
+					case "alt+g":
+						// Jump to a message by its number, shown while asking
+						return m, m.startPrompt("Go to message:", "", promptGoto)
+					case "alt+m":
+						// Set the model and parameters of this conversation's requests
+						if m.readOnly() {
+							return m, nil
+						}
+						current := ""
+						if m.conversation.Settings != nil {
+							current = formatSettings(m.conversation.Settings)
+						}
+						return m, m.startPrompt("Settings (model= max_tokens= temperature=):", current, promptSettings)
+					case "alt+q":
+						// Show the request sent to the API, for bug reports
+						if !m.debug {
+							return m, nil
+						}
+						messages := toClaudeMessages(limitContext(m.messages, m.config.ContextMessages))
+						request, sent, err := m.client.DebugRequest(messages, m.requestParams(m.client))
+						if err != nil {
+							m.fail(err)
+							return m, nil
+						}
+						m.debugRequest = request
+						m.debugSent = sent
+						m.mode = ModeDebug
+						m.updateViewport()
+						return m, nil
+					case "alt+-":
+						// Mark where a new phase of the work starts
+						if m.isLoading {
+							m.notice = "Wait for the response to finish before adding a divider"
+							return m, nil
+						}
+						if m.readOnly() {
+							return m, nil
+						}
+						return m, m.startPrompt("Divider label (optional):", "", promptDivider)
+					case "alt+f":
+						// Show only the messages flagged in edit mode
+						m.flaggedOnly = !m.flaggedOnly
+						if m.flaggedOnly {
+							m.showToast("Showing flagged messages only", false)
+						} else {
+							m.showToast("Showing all messages", false)
+						}
+						m.updateViewport()
+						m.viewport.GotoTop()
+						return m, nil
+					case "alt+s":
+						// Show stats across all stored conversations
+						conversations, err := m.storage.ListConversations()
+						if err != nil {
+							m.fail(err)
+							return m, nil
+						}
+						m.stats = computeStats(conversations)
+						m.mode = ModeStats
+						m.updateViewport()
+						return m, nil
+					case "alt+c":
+						// Send the input as code instead of a question
+						m.codeBlock = !m.codeBlock
+						return m, nil
+					case "alt+d":
+						// Change where this conversation's commands run
+						dir, _ := m.commandDir()
+						if dir == "" {
+							dir, _ = os.Getwd()
+						}
+						return m, m.startPrompt("Working directory:", dir, promptWorkDir)
+					case "alt+p":
+						// Open a path from the latest response
+						for i := len(m.messages) - 1; i >= 0; i-- {
+							if m.messages[i].Role == "assistant" && len(extractPaths(m.messages[i].Content)) > 0 {
+								return m, m.choosePath(i)
+							}
+						}
+						m.notice = "No paths in the conversation to open"
+						return m, nil
+					case "alt+i":
+						// Start a chat about a file, e.g. a project's README
+						return m, m.startPrompt("Start a new chat with this file as context:", "", promptContextFile)
+					case "alt+u":
+						// Hide everything but the conversation and input, e.g. to record a demo
+						m.config.MinimalUI = !m.config.MinimalUI
+						if m.config.MinimalUI {
+							m.notice = "Minimal UI, Alt+U brings the rest back"
+						}
+						m.updateViewport()
+						return m, nil
+					case "alt+b":
+						// Copy the last command with its output and exit status, e.g. for a bug report
+						if m.lastCommand == "" {
+							m.notice = "No command run yet"
+							return m, nil
+						}
+						return m, copyToClipboard(transcript(m.lastCommand, stripANSI(m.lastOutput), m.lastExitCode, m.lastTruncated), "command transcript")
+					case "alt+v":
+						// Read through the last command's whole output
+						if m.lastCommand == "" {
+							m.notice = "No command output to view yet"
+							return m, nil
+						}
+						m.mode = ModeOutput
+						m.updateViewport()
+						return m, nil
+					case "alt+o":
+						// Pick lines of the last command's output to attach
+						if m.lastCommand == "" {
+							m.notice = "No command output to attach yet"
+							return m, nil
+						}
+						output := m.lastOutput
+						if m.config.StripANSI {
+							output = stripANSI(output)
+						}
+						m.outputLines = strings.Split(strings.TrimRight(output, "\n"), "\n")
+						m.outputCursor = 0
+						m.outputAnchor = -1
+						m.mode = ModeOutputSelect
+						m.updateViewport()
+						m.viewport.GotoTop()
+						return m, nil
 					case "j", "k":
 						m.mode = ModeEditing
 						m.cursorIndex = len(m.messages) - 1
@@ -400,20 +1093,22 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				}
 			case tea.KeyCtrlR:
 				m.mode = ModeHistory
-				conversations, err := m.storage.ListConversations()
-				if err != nil {
-					m.err = err
-					return m, nil
-				}
-				m.conversations = conversations
-				m.selectedConv = 0
+				m.clearSearch()
 				m.updateViewport()
 			case tea.KeyCtrlH:
 				m.mode = ModeHelp
+				m.updateViewport()
 				return m, nil
 			}
 
-			// Finally update text input
+			// Finally update text input, which can't be typed in while the
+			// conversation is read-only
+			if m.conversation.ReadOnly {
+				if msg.Type == tea.KeyRunes || msg.Type == tea.KeySpace {
+					m.readOnly()
+				}
+				return m, tea.Batch(cmds...)
+			}
 			var cmd tea.Cmd
 			m.textInput, cmd = m.textInput.Update(msg)
 			cmds = append(cmds, cmd)
@@ -441,26 +1136,81 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					if m.messages[m.cursorIndex].Role == "assistant" {
 						return m.handleCommandExecution()
 					}
+				case "o":
+					// Open a path from the selected message
+					if m.messages[m.cursorIndex].Role == "assistant" {
+						return m, m.choosePath(m.cursorIndex)
+					}
+				case "m":
+					// Flip an assistant message between formatted and raw text
+					if m.messages[m.cursorIndex].Role == "assistant" {
+						key := messageKey{m.conversation.ID, m.cursorIndex}
+						m.plainMessages[key] = !m.plainMessages[key]
+						m.ensureMessageVisible(m.cursorIndex)
+					}
+					return m, nil
+				case "t":
+					// Expand or collapse the model's reasoning
+					if m.messages[m.cursorIndex].Thinking != "" {
+						key := messageKey{m.conversation.ID, m.cursorIndex}
+						m.showThinking[key] = !m.showThinking[key]
+						m.ensureMessageVisible(m.cursorIndex)
+					}
+					return m, nil
+				case "d":
+					// Remove a divider
+					if m.messages[m.cursorIndex].Role == dividerRole && !m.readOnly() {
+						m.messages = append(m.messages[:m.cursorIndex], m.messages[m.cursorIndex+1:]...)
+						m.conversation.Messages = m.messages
+						if hasUserMessage(m.conversation) {
+							m.saveConversation(m.conversation)
+						}
+						m.cursorIndex = min(m.cursorIndex, len(m.messages)-1)
+						if m.cursorIndex < 1 {
+							m.mode = ModeNormal
+						}
+						m.updateViewport()
+					}
+					return m, nil
+				case "f":
+					// Flag or unflag the message as important
+					if role := m.messages[m.cursorIndex].Role; role != "system" && role != dividerRole && !m.readOnly() {
+						m.messages[m.cursorIndex].Flagged = !m.messages[m.cursorIndex].Flagged
+						m.conversation.Messages = m.messages
+						m.saveConversation(m.conversation)
+						m.ensureMessageVisible(m.cursorIndex)
+					}
+					return m, nil
+				case "e":
+					// Expand or collapse a long response
+					if m.collapsible(m.cursorIndex) {
+						key := messageKey{m.conversation.ID, m.cursorIndex}
+						m.expanded[key] = !m.expanded[key]
+						m.ensureMessageVisible(m.cursorIndex)
+					}
+					return m, nil
+				case "s":
+					// Open this conversation's system prompt in the editor
+					if len(m.messages) > 0 && m.messages[0].Role == "system" && !m.readOnly() {
+						return m, editMessageCmd(m.editor(), m.messages[0].Content, 0)
+					}
+				case "w", "W":
+					// Save the message to a file, W without tags and fences
+					text := m.messages[m.cursorIndex].Content
+					label := "Save message to:"
+					if msg.String() == "W" {
+						text = stripDecoration(text)
+						label = "Save message without tags and fences to:"
+					}
+					m.exportText = text
+					name := fmt.Sprintf("gpt-term-message-%s.txt", time.Now().Format("20060102-150405"))
+					return m, m.startPrompt(label, name, promptSaveMessage)
 				case "c":
 					// Copy current message to clipboard
 					if m.cursorIndex < len(m.messages) {
 						msg := m.messages[m.cursorIndex]
-						cmd, err := getClipboardCommand()
-						if err != nil {
-							m.err = err
-							return m, nil
-						}
-						cmd.Stdin = strings.NewReader(msg.Content)
 						m.mode = ModeNormal // Set mode back to normal before executing command
-						return m, tea.ExecProcess(
-							cmd,
-							func(err error) tea.Msg {
-								if err != nil {
-									return nil
-								}
-								return nil
-							},
-						)
+						return m, copyToClipboard(msg.Content, "message")
 					}
 				}
 			case tea.KeyUp:
@@ -471,7 +1221,10 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, nil
 			case tea.KeyEnter:
 				if m.messages[m.cursorIndex].Role == "user" {
-					return m, editMessageCmd(m.messages[m.cursorIndex].Content, m.cursorIndex)
+					if m.readOnly() {
+						return m, nil
+					}
+					return m, editMessageCmd(m.editor(), m.messages[m.cursorIndex].Content, m.cursorIndex)
 				}
 				m.mode = ModeNormal
 				m.updateViewport()
@@ -480,18 +1233,23 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case ModeHistory:
 			switch msg.Type {
 			case tea.KeyEsc:
-				m.mode = ModeNormal
+				// Clear a search first, then leave the history
+				if m.searchQuery != "" {
+					m.clearSearch()
+				} else {
+					m.mode = ModeNormal
+				}
 				m.updateViewport()
 			case tea.KeyUp:
 				oldSelected := m.selectedConv
-				m.selectedConv = max(0, m.selectedConv-1)
+				m.selectedConv = m.stepSelection(m.selectedConv, -1, len(m.conversations))
 				if oldSelected != m.selectedConv {
 					m.ensureConversationVisible(m.selectedConv)
 				}
 				return m, nil
 			case tea.KeyDown:
 				oldSelected := m.selectedConv
-				m.selectedConv = min(len(m.conversations)-1, m.selectedConv+1)
+				m.selectedConv = m.stepSelection(m.selectedConv, 1, len(m.conversations))
 				if oldSelected != m.selectedConv {
 					m.ensureConversationVisible(m.selectedConv)
 				}
@@ -518,21 +1276,62 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.selectedConv = len(m.conversations) - 1
 				m.ensureConversationVisible(m.selectedConv)
 				return m, nil
+			case tea.KeyRunes:
+				switch msg.String() {
+				case "/":
+					return m, m.startPrompt("Search conversations:", m.searchQuery, promptSearch)
+				case "d":
+					// Duplicate the selected conversation and select the copy
+					if len(m.conversations) > 0 {
+						selected := m.sortedConversations()[m.selectedConv]
+						dup, err := m.storage.DuplicateConversation(selected.ID)
+						if err != nil {
+							m.fail(err)
+							return m, nil
+						}
+						conversations, err := m.storage.ListConversations()
+						if err != nil {
+							m.fail(err)
+							return m, nil
+						}
+						m.conversations = conversations
+						m.searchQuery = ""
+						m.searchResults = nil
+						for i, conv := range m.sortedConversations() {
+							if conv.ID == dup.ID {
+								m.selectedConv = i
+								break
+							}
+						}
+						m.ensureConversationVisible(m.selectedConv)
+					}
+					return m, nil
+				case "l":
+					if len(m.conversations) > 0 {
+						m.toggleReadOnly(m.sortedConversations()[m.selectedConv].ID)
+					}
+					return m, nil
+				case "t":
+					// Cycle full, relative and date-only timestamps
+					modes := config.HistoryTimestampModes
+					next := modes[(slices.Index(modes, m.config.HistoryTimestamps)+1)%len(modes)]
+					m.config.HistoryTimestamps = next
+					if err := config.SaveSetting("history_timestamps", next); err != nil {
+						m.fail(err)
+					}
+					m.notice = "Showing " + next + " timestamps"
+					m.updateViewport()
+					return m, nil
+				}
+			case tea.KeyCtrlR:
+				m.refreshHistory()
+				return m, nil
 			case tea.KeyEnter:
 				if len(m.conversations) > 0 {
-					// Create sorted copy of conversations
-					sortedConvs := make([]storage.Conversation, len(m.conversations))
-					copy(sortedConvs, m.conversations)
-					sort.Slice(sortedConvs, func(i, j int) bool {
-						return sortedConvs[i].CreatedAt.After(sortedConvs[j].CreatedAt)
-					})
-
 					// Use the sorted conversations for selection
-					m.conversation = &sortedConvs[m.selectedConv]
-					m.messages = m.conversation.Messages
+					sortedConvs := m.sortedConversations()
 					m.mode = ModeNormal
-					m.updateViewport()
-					m.viewport.GotoBottom()
+					m.openConversation(&sortedConvs[m.selectedConv])
 				}
 			}
 
@@ -541,257 +1340,2529 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			case tea.KeyEsc:
 				m.mode = ModeNormal
 			case tea.KeyUp:
-				if m.selectedCommand > 0 {
-					m.selectedCommand--
-				}
+				m.selectedCommand = m.stepSelection(m.selectedCommand, -1, len(m.commands))
+				return m, m.explainSelected()
 			case tea.KeyDown:
-				if m.selectedCommand < len(m.commands)-1 {
-					m.selectedCommand++
-				}
+				m.selectedCommand = m.stepSelection(m.selectedCommand, 1, len(m.commands))
+				return m, m.explainSelected()
 			case tea.KeyEnter:
 				if len(m.commands) > 0 {
-					cmdStr := m.commands[m.selectedCommand][1]
-					m.mode = ModeNormal
-					return m, executeCommand(cmdStr)
+					return m.runCommand(m.selectedCommand)
 				}
 			case tea.KeyRunes:
 				switch msg.String() {
+				case "?":
+					m.showExplanation = !m.showExplanation
+					return m, m.explainSelected()
+				case "w":
+					m.config.TruncateCommands = !m.config.TruncateCommands
+					if err := config.SaveSetting("truncate_commands", m.config.TruncateCommands); err != nil {
+						m.fail(err)
+					}
+					m.updateViewport()
 				case "c":
 					if len(m.commands) > 0 {
-						cmdStr := m.commands[m.selectedCommand][1]
-						cmd, err := getClipboardCommand()
+						cmdStr := m.commands[m.selectedCommand].text
+						m.mode = ModeNormal
+						return m, copyToClipboard(cmdStr, "command")
+					}
+				case "o":
+					if len(m.commands) > 0 {
+						line, err := oneLiner(m.commands[m.selectedCommand].text)
 						if err != nil {
-							m.err = err
+							m.notice = "Can't put this one on one line, " + err.Error() + ". Press C to copy it as it is."
 							return m, nil
 						}
-						cmd.Stdin = strings.NewReader(cmdStr)
 						m.mode = ModeNormal
-						return m, tea.ExecProcess(cmd, func(err error) tea.Msg {
-							if err != nil {
-								return nil
-							}
-							return nil
-						})
+						return m, copyToClipboard(line, "command as one line")
+					}
+				case "l":
+					if len(m.commands) > 0 {
+						return m.runLive(m.selectedCommand)
 					}
 				default:
 					// Handle numeric selection
 					if num, err := strconv.Atoi(msg.String()); err == nil && num > 0 && num <= len(m.commands) {
-						cmdStr := m.commands[num-1][1]
-						m.mode = ModeNormal
-						return m, executeCommand(cmdStr)
+						return m.runCommand(num - 1)
 					}
 				}
 			}
 
-		case ModeHelp:
-			m.mode = ModeNormal
-			m.updateViewport()
+		case ModeHelp, ModeStats, ModeDebug, ModeOutput:
+			switch key := msg.String(); key {
+			case "esc", "q", "ctrl+h":
+				m.mode = ModeNormal
+				m.updateViewport()
+			case "/":
+				return m, m.startPrompt("Search:", "", promptPagerSearch)
+			case "c":
+				switch m.mode {
+				case ModeDebug:
+					return m, copyToClipboard(m.debugRequest, "request")
+				case ModeOutput:
+					return m, copyToClipboard(m.lastOutput, "command output")
+				}
+			default:
+				m.pager.Update(&m.viewport, key)
+			}
+			return m, nil
+
+		case ModeOutputSelect:
+			switch msg.String() {
+			case "esc":
+				m.mode = ModeNormal
+				m.updateViewport()
+			case "up", "k":
+				m.outputCursor = max(0, m.outputCursor-1)
+				m.ensureOutputLineVisible()
+			case "down", "j":
+				m.outputCursor = min(len(m.outputLines)-1, m.outputCursor+1)
+				m.ensureOutputLineVisible()
+			case " ", "v":
+				// Start a selection at the cursor, or drop the current one
+				if m.outputAnchor == -1 {
+					m.outputAnchor = m.outputCursor
+				} else {
+					m.outputAnchor = -1
+				}
+				m.updateViewport()
+			case "a":
+				m.attachOutput(0, len(m.outputLines)-1)
+			case "enter":
+				// Attach the selection, or just the line under the cursor
+				start, end := m.outputSelection()
+				m.attachOutput(start, end)
+			}
+			return m, nil
+
+		case ModeTemplateSelect:
+			// The built-in personas come first, then the configured templates
+			count := len(persona.Builtin) + len(m.config.Templates)
+			switch msg.Type {
+			case tea.KeyEsc:
+				m.mode = ModeNormal
+				m.updateViewport()
+			case tea.KeyUp:
+				m.selectedTemplate = m.stepSelection(m.selectedTemplate, -1, count)
+				m.updateViewport()
+			case tea.KeyDown:
+				m.selectedTemplate = m.stepSelection(m.selectedTemplate, 1, count)
+				m.updateViewport()
+			case tea.KeyEnter:
+				tmpl := config.Template{}
+				if m.selectedTemplate < len(persona.Builtin) {
+					tmpl.Persona = persona.Builtin[m.selectedTemplate].Name
+				} else {
+					tmpl = m.config.Templates[m.selectedTemplate-len(persona.Builtin)]
+				}
+				m.startConversation(tmpl)
+			}
 			return m, nil
+
+		case ModePrompt:
+			switch msg.Type {
+			case tea.KeyEsc:
+				m.mode = m.promptReturn
+				m.updateViewport()
+				return m, nil
+			case tea.KeyEnter:
+				m.mode = m.promptReturn
+				value := strings.TrimSpace(m.promptInput.Value())
+				cmd := m.handlePrompt(value)
+				m.updateViewport()
+				return m, cmd
+			}
+			var cmd tea.Cmd
+			m.promptInput, cmd = m.promptInput.Update(msg)
+			return m, cmd
+		}
+
+	case retryMsg:
+		if msg.stream != m.streamCh {
+			return m, waitForStream(msg.stream)
+		}
+		m.retry = &msg.info
+		m.retryAt = time.Now().Add(msg.info.Wait)
+		return m, tea.Batch(append(cmds, waitForStream(msg.stream))...)
+
+	case streamChunkMsg:
+		// Keep draining streams we no longer show so their goroutines can finish
+		if msg.stream != m.streamCh {
+			return m, waitForStream(msg.stream)
+		}
+		m.retry = nil
+		if msg.thinking {
+			m.streamConv.Messages[m.streamIndex].Thinking += msg.text
+		} else {
+			m.streamConv.Messages[m.streamIndex].Content += msg.text
+		}
+		if m.streamConv == m.conversation {
+			m.updateViewport()
+			if m.following {
+				m.viewport.GotoBottom()
+			}
 		}
+		return m, tea.Batch(append(cmds, waitForStream(msg.stream))...)
 
 	case apiResponseMsg:
+		if msg.stream != m.streamCh {
+			return m, nil
+		}
 		m.isLoading = false
-		if msg.err != nil {
+		m.streamCh = nil
+		m.streamCancel()
+		m.retry = nil
+
+		// The response may belong to a conversation we've since switched away from
+		conv := m.streamConv
+		reply := &conv.Messages[m.streamIndex]
+		conv.InputTokens += msg.usage.InputTokens
+		conv.OutputTokens += msg.usage.OutputTokens
+		// Added up, since a continued response streams into the same message
+		reply.InputTokens += msg.usage.InputTokens
+		reply.OutputTokens += msg.usage.OutputTokens
+
+		// A dropped connection keeps whatever text made it through so it can
+		// be resumed, any other failure discards the response
+		interrupted := errors.Is(msg.err, claude.ErrStreamInterrupted) && reply.Content != ""
+		stopped := m.stopping && errors.Is(msg.err, context.Canceled) && reply.Content != ""
+		m.stopping = false
+		if msg.err != nil && !interrupted && !stopped {
 			m.err = msg.err
+
+			// An empty answer isn't a failure of the app, just tell the user
+			var emptyErr *claude.EmptyResponseError
+			var apiErr *claude.APIError
+			if errors.As(msg.err, &emptyErr) {
+				m.notice = emptyErr.Error()
+			} else if errors.As(msg.err, &apiErr) {
+				m.notice = apiErr.Error()
+			} else if errors.Is(msg.err, context.Canceled) {
+				m.notice = "Request cancelled"
+			} else {
+				m.fail(msg.err)
+			}
+
+			if reply.Content == "" {
+				conv.Messages = conv.Messages[:m.streamIndex]
+				if conv == m.conversation {
+					m.messages = conv.Messages
+				}
+				// A cancelled request was given up on, anything else may work
+				// with another model
+				if !errors.Is(msg.err, context.Canceled) {
+					m.fallbackReason = "Request failed"
+					if m.notice != "" {
+						m.fallbackReason = m.notice
+					}
+				}
+			}
+			m.updateViewport()
+			return m, nil
+		}
+
+		reply.Timestamp = time.Now()
+		if msg.cached {
+			m.notice = "Answered from the cache"
+		}
+		switch {
+		case stopped:
+			reply.Truncated = "Response stopped early"
+		case interrupted:
+			reply.Truncated = "Connection dropped mid-response"
+		case msg.stopReason == "max_tokens":
+			reply.Truncated = "Response hit the token limit"
+		}
+
+		// Generate summary from the first user message that says what the
+		// chat is about, or ask the model when they're all like "hi"
+		if conv.Summary == "" {
+			if summary, ok := storage.SubstantiveSummary(conv.Messages); ok {
+				conv.Summary = summary
+			} else if !m.summarizing[conv.ID] {
+				m.summarizing[conv.ID] = true
+				cmds = append(cmds, summarizeCmd(m.client, conv, false))
+			}
+		}
+
+		m.saveConversation(conv)
+
+		// Update viewport with new content
+		if conv == m.conversation {
+			m.messages = conv.Messages
+			m.updateViewport()
+			if m.following {
+				m.viewport.GotoBottom()
+			} else {
+				m.newBelow = true
+			}
+		}
+
+	case editMessageMsg:
+		if msg.err != nil {
+			m.fail(msg.err)
+			return m, nil
+		}
+
+		if msg.index == notesIndex {
+			m.conversation.Notes = strings.TrimSpace(msg.edited)
+			// A chat is only saved once it has a message, the notes go with it
+			saved := hasUserMessage(m.conversation)
+			if saved {
+				m.saveConversation(m.conversation)
+			}
+			switch {
+			case m.conversation.Notes == "":
+				m.showToast("Notes removed", false)
+			case !saved:
+				m.showToast("Notes kept, they're saved with the chat once you send a message", false)
+			default:
+				m.showToast("Notes saved", false)
+			}
+			return m, nil
+		}
+
+		// Editing the system prompt only changes the instructions for this
+		// conversation, it doesn't rewind the history or send anything
+		if m.messages[msg.index].Role == "system" {
+			edited := strings.TrimSpace(msg.edited)
+			if edited == "" {
+				edited = personaPrompt(m.conversation.Persona)
+			}
+			m.messages[msg.index].Content = edited
+			m.conversation.Messages = m.messages
+			m.saveConversation(m.conversation)
+			m.updateViewport()
+			return m, nil
+		}
+
+		// Rewinding drops everything after the message, so check first
+		if later := len(m.messages) - msg.index - 1; later > 0 {
+			m.pendingEdit = &msg
+			return m, m.startPrompt(fmt.Sprintf("This edit will discard %d later message(s). Continue? (y/n)", later), "n", promptConfirmEdit)
+		}
+		return m, m.applyEdit(msg)
+
+	case commandOutputMsg:
+		// Kept even when it failed, so it can be shared with Alt+B
+		m.lastCommand = msg.command
+		m.lastOutput = msg.raw
+		m.lastExitCode = msg.exitCode
+		m.lastTruncated = msg.truncated
+		if msg.err != nil {
+			m.fail(fmt.Errorf("command failed: %w", msg.err))
+			return m, nil
+		}
+		if msg.truncated {
+			m.notice = fmt.Sprintf("Output truncated at %d MB", m.config.MaxOutputMB)
+		}
+
+		if m.conversation.ReadOnly {
+			m.showToast("The conversation is read-only, so the output wasn't added. Ctrl+S saves it.", false)
 			return m, nil
 		}
+
+		output := msg.output
+		if m.config.StripANSI {
+			output = stripANSI(output)
+		}
+
+		// Add command output as assistant message
 		botMsg := storage.Message{
 			Role:      "assistant",
-			Content:   msg.response,
+			Content:   "```\n" + output + "```",
 			Timestamp: time.Now(),
 		}
 		m.messages = append(m.messages, botMsg)
 		m.conversation.Messages = m.messages
+		m.saveConversation(m.conversation)
+
+		// Update viewport with new content and scroll to bottom
+		m.updateViewport()
+		if m.following {
+			m.viewport.GotoBottom()
+		} else {
+			m.newBelow = true
+		}
+		return m, nil
+
+	case clipboardMsg:
+		text := strings.TrimSpace(msg.text)
+		switch {
+		case msg.err != nil:
+			m.notice = "Couldn't read the clipboard: " + msg.err.Error()
+		case text == "":
+			m.notice = "The clipboard is empty"
+		default:
+			m.attachment = "```\n" + text + "\n```"
+			m.attachmentName = "Clipboard"
+		}
+		return m, nil
+
+	case explanationMsg:
+		if msg.err != nil {
+			// Leave it unexplained so it can be retried
+			delete(m.explanations, msg.command)
+			m.notice = "Couldn't explain the command: " + msg.err.Error()
+			return m, nil
+		}
+		m.explanations[msg.command] = strings.TrimSpace(msg.text)
+		return m, nil
+
+	case summaryMsg:
+		delete(m.summarizing, msg.conv.ID)
+		// The conversation may have been reopened or saved elsewhere while the
+		// summary was made
+		conv := m.liveConversation(msg.conv)
+		if conv == msg.conv {
+			if onDisk, err := m.storage.LoadConversation(conv.ID); err == nil && onDisk.Version > conv.Version {
+				conv = onDisk
+			}
+		}
+		if msg.fresh {
+			summary := cleanSummary(msg.summary)
+			switch {
+			case msg.err != nil:
+				m.fail(fmt.Errorf("error summarizing conversation: %w", msg.err))
+			case summary == "":
+				m.notice = "The model didn't come up with a summary, the old one stays"
+			default:
+				conv.Summary = summary
+				m.saveConversation(conv)
+				m.showToast("Summary updated: "+summary, false)
+			}
+			return m, nil
+		}
+		if conv.Summary != "" {
+			// Renamed in the meantime
+			return m, nil
+		}
+		summary := cleanSummary(msg.summary)
+		if msg.err != nil || summary == "" {
+			summary = m.storage.GenerateConversationSummary(conv.Messages)
+		}
+		conv.Summary = summary
+		m.saveConversation(conv)
+		return m, nil
+
+	case liveTickMsg:
+		// A tick of a live command that was stopped since
+		if msg.live != m.live {
+			return m, nil
+		}
+		return m.feedLive()
+
+	case toastExpiredMsg:
+		if msg.id == m.toastID {
+			m.toast = ""
+		}
+		return m, nil
+
+	case pathOpenedMsg:
+		if msg.err != nil {
+			m.fail(fmt.Errorf("error opening %s: %w", msg.path, msg.err))
+		}
+		return m, nil
+
+	case copiedMsg:
+		if msg.err != nil {
+			m.fail(fmt.Errorf("error copying to clipboard: %w", msg.err))
+		} else {
+			m.showToast("Copied "+msg.what, false)
+		}
+		return m, nil
+
+	case pipedMsg:
+		if msg.err != nil {
+			m.fail(fmt.Errorf("error running pipe_command: %w", msg.err))
+		} else {
+			m.showToast("Sent the conversation to pipe_command", false)
+		}
+		return m, nil
+
+	case recoveryTickMsg:
+		m.writeRecovery()
+		return m, recoveryTick()
+
+	case scrollMsg:
+		m.viewport.YOffset = msg.offset
+		fmt.Fprintf(os.Stderr, "DEBUG: Applied scroll offset: %d\n", msg.offset)
+		return m, nil
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+// applyEdit replaces the message being edited, drops everything after it and
+// asks for a new response
+func (m *model) applyEdit(msg editMessageMsg) tea.Cmd {
+	if m.config.TrimMessages {
+		msg.edited = trimMessage(msg.edited)
+	}
+	m.messages[msg.index].Content = msg.edited
+	m.messages = m.messages[:msg.index+1]
+	m.conversation.Messages = m.messages
+	m.updateViewport()
+	m.viewport.GotoBottom()
+
+	// Regenerate summary if first user message was edited
+	if summary, ok := storage.SubstantiveSummary(m.messages); ok {
+		m.conversation.Summary = summary
+	}
+
+	m.saveConversation(m.conversation)
+	m.mode = ModeNormal
+
+	cmd := m.streamResponse()
+	m.updateViewport()
+	return cmd
+}
+
+const readOnlyNotice = "This conversation is read-only, press L on it in the history (Ctrl+R) to unlock it"
+
+// readOnly reports whether the open conversation is read-only, saying so in
+// the notice when it is
+func (m *model) readOnly() bool {
+	if m.conversation.ReadOnly {
+		m.notice = readOnlyNotice
+	}
+	return m.conversation.ReadOnly
+}
+
+// toggleReadOnly locks or unlocks the conversation with id against changes
+func (m *model) toggleReadOnly(id string) {
+	conv := m.conversation
+	if m.streamConv != nil && m.streamConv.ID == id {
+		conv = m.streamConv
+	}
+	if conv.ID != id {
+		loaded, err := m.storage.LoadConversation(id)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		conv = loaded
+	}
+	conv.ReadOnly = !conv.ReadOnly
+	if err := m.storage.SaveConversation(conv); err != nil {
+		conv.ReadOnly = !conv.ReadOnly
+		m.fail(fmt.Errorf("error saving conversation: %w", err))
+		return
+	}
+
+	for i := range m.conversations {
+		if m.conversations[i].ID == id {
+			m.conversations[i].ReadOnly = conv.ReadOnly
+			m.conversations[i].Version = conv.Version
+		}
+	}
+	if conv.ReadOnly {
+		m.showToast("Read-only, it can be opened but not changed", false)
+	} else {
+		m.showToast("Unlocked, it can be changed again", false)
+	}
+}
+
+// startPrompt switches to the prompt input, asking for a value for action
+func (m *model) startPrompt(label, initial string, action promptAction) tea.Cmd {
+	m.promptInput = textinput.New()
+	m.promptInput.Width = m.width - lipgloss.Width(label) - 4
+	m.promptInput.SetValue(initial)
+	m.promptInput.CursorEnd()
+	m.promptLabel = label
+	m.promptAction = action
+	m.promptReturn = m.mode
+	m.mode = ModePrompt
+	m.updateViewport()
+	return m.promptInput.Focus()
+}
+
+// handlePrompt acts on a value entered in the prompt input
+func (m *model) handlePrompt(value string) tea.Cmd {
+	switch m.promptAction {
+	case promptGoto:
+		if value != "" {
+			m.gotoMessage(value)
+		}
+	case promptPagerSearch:
+		if value != "" && !m.pager.Search(&m.viewport, value) {
+			m.notice = fmt.Sprintf("No match for %q", value)
+		}
+	case promptSaveMessage:
+		if value == "" {
+			return nil
+		}
+		path, err := saveOutput(value, m.exportText)
+		if err != nil {
+			m.fail(fmt.Errorf("error saving message: %w", err))
+		} else {
+			m.showToast("Message saved to "+path, false)
+		}
+	case promptSaveOutput:
+		if value == "" {
+			return nil
+		}
+		path, err := saveOutput(value, m.lastOutput)
+		if err != nil {
+			m.fail(fmt.Errorf("error saving output: %w", err))
+		} else {
+			m.showToast("Output saved to "+path, false)
+		}
+	case promptRename:
+		if value == "" || value == m.conversation.Summary {
+			return nil
+		}
+		if err := m.storage.RenameConversation(m.conversation, value); err != nil {
+			m.fail(fmt.Errorf("error renaming conversation: %w", err))
+		} else {
+			m.showToast("Conversation renamed", false)
+		}
+	case promptContextFile:
+		if value == "" {
+			return nil
+		}
+		path, content, warning, err := readContextFile(value)
+		if err != nil {
+			m.fail(err)
+			return nil
+		}
+		m.startConversation(config.Template{Persona: m.config.Persona})
+		seedContext(m.conversation, path, content)
+		m.messages = m.conversation.Messages
+		m.notice = "New chat with " + filepath.Base(path) + " as context"
+		if warning != "" {
+			m.showToast(warning, false)
+		}
+	case promptWorkDir:
+		if value == "" {
+			return nil
+		}
+		dir, err := expandPath(value)
+		if err == nil {
+			if info, statErr := os.Stat(dir); statErr != nil || !info.IsDir() {
+				err = fmt.Errorf("%s is not a directory", dir)
+			}
+		}
+		if err != nil {
+			m.fail(err)
+			return nil
+		}
+		m.conversation.Dir = dir
+		if hasUserMessage(m.conversation) {
+			m.saveConversation(m.conversation)
+		}
+		m.showToast("Commands in this chat run in "+dir, false)
+	case promptPlaceholder:
+		return m.fillPlaceholder(value)
+	case promptSettings:
+		settings, err := parseSettings(value)
+		if err != nil {
+			m.fail(err)
+			return nil
+		}
+		m.conversation.Settings = settings
+		if hasUserMessage(m.conversation) {
+			m.saveConversation(m.conversation)
+		}
+		if settings == nil {
+			m.showToast("This chat uses the config's settings again", false)
+		} else {
+			m.showToast("This chat now uses "+formatSettings(settings), false)
+		}
+	case promptOpenPath:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > len(m.paths) {
+			m.notice = fmt.Sprintf("Pick a path from 1 to %d", len(m.paths))
+			return nil
+		}
+		return m.openPath(m.paths[n-1])
+	case promptDivider:
+		m.messages = append(m.messages, storage.Message{
+			Role:      dividerRole,
+			Content:   value,
+			Timestamp: time.Now(),
+		})
+		m.conversation.Messages = m.messages
+		if hasUserMessage(m.conversation) {
+			m.saveConversation(m.conversation)
+		}
+		m.updateViewport()
+		m.viewport.GotoBottom()
+	case promptStopForNew:
+		if !strings.HasPrefix(strings.ToLower(value), "y") {
+			return nil
+		}
+		if m.isLoading {
+			// Keep what has arrived so far, like Esc does
+			m.stopping = true
+			m.streamCancel()
+		}
+		m.pickTemplate()
+	case promptConfirmEdit:
+		edit := m.pendingEdit
+		m.pendingEdit = nil
+		if edit != nil && strings.HasPrefix(strings.ToLower(value), "y") {
+			return m.applyEdit(*edit)
+		}
+	case promptRecover:
+		if strings.HasPrefix(strings.ToLower(value), "y") {
+			m.recover()
+		}
+		if err := m.storage.DiscardRecovery(m.recoveryPath); err != nil {
+			m.fail(err)
+		}
+		m.recovered = nil
+	case promptSearch:
+		if value == "" {
+			m.clearSearch()
+			return nil
+		}
+		results, err := m.storage.SearchConversations(value)
+		if err != nil {
+			m.notice = "Error searching: " + err.Error()
+			return nil
+		}
+		m.searchQuery = value
+		m.showSearchResults(results)
+		m.selectedConv = 0
+		m.viewport.GotoTop()
+	}
+	return nil
+}
+
+// showSearchResults lists the conversations found by a history search
+func (m *model) showSearchResults(results []storage.SearchResult) {
+	m.searchResults = make(map[string]storage.SearchResult)
+	m.conversations = nil
+	for _, result := range results {
+		m.conversations = append(m.conversations, result.Conversation)
+		m.searchResults[result.Conversation.ID] = result
+	}
+}
+
+// refreshHistory reads the history list again, e.g. to pick up conversations
+// saved by another gpt-term, keeping the search and the selected conversation
+func (m *model) refreshHistory() {
+	var selectedID string
+	if sorted := m.sortedConversations(); m.selectedConv < len(sorted) {
+		selectedID = sorted[m.selectedConv].ID
+	}
+
+	if m.searchQuery != "" {
+		results, err := m.storage.SearchConversations(m.searchQuery)
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		m.showSearchResults(results)
+	} else {
+		conversations, err := m.storage.ListConversations()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		m.conversations = conversations
+	}
+
+	m.selectedConv = min(m.selectedConv, max(0, len(m.conversations)-1))
+	for i, conv := range m.sortedConversations() {
+		if conv.ID == selectedID {
+			m.selectedConv = i
+			break
+		}
+	}
+	m.showToast(fmt.Sprintf("History refreshed, %d conversations", len(m.conversations)), false)
+	m.ensureConversationVisible(m.selectedConv)
+}
+
+// outputSelection returns the first and last selected output lines
+func (m model) outputSelection() (int, int) {
+	if m.outputAnchor == -1 {
+		return m.outputCursor, m.outputCursor
+	}
+	return min(m.outputAnchor, m.outputCursor), max(m.outputAnchor, m.outputCursor)
+}
+
+// attachOutput attaches lines start to end of the last command output to the
+// next prompt and goes back to the input
+func (m *model) attachOutput(start, end int) {
+	lines := m.outputLines[start : end+1]
+	m.attachment = fmt.Sprintf("Output of `%s`:\n```\n%s\n```", m.lastCommand, strings.Join(lines, "\n"))
+	if len(lines) == len(m.outputLines) {
+		m.attachmentName = "Command output"
+	} else {
+		m.attachmentName = fmt.Sprintf("%d lines of command output", len(lines))
+	}
+	m.mode = ModeNormal
+	m.updateViewport()
+}
+
+// ensureOutputLineVisible redraws the output selection and scrolls so the
+// cursor stays on screen
+func (m *model) ensureOutputLineVisible() {
+	m.updateViewport()
+	line := m.outputCursor + strings.Count(outputSelectTitle, "\n")
+	if line < m.viewport.YOffset {
+		m.viewport.SetYOffset(line)
+	} else if line >= m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(line - m.viewport.Height + 1)
+	}
+}
+
+// clearSearch goes back to listing every conversation in the history
+func (m *model) clearSearch() {
+	m.searchQuery = ""
+	m.searchResults = nil
+	conversations, err := m.storage.ListConversations()
+	if err != nil {
+		m.fail(err)
+		return
+	}
+	m.conversations = conversations
+	m.selectedConv = 0
+}
+
+// fenceLineRe matches the opening and closing lines of a code fence
+var fenceLineRe = regexp.MustCompile("(?m)^[ \t]*```+[\\w+-]*[ \t]*\n?")
+
+// stripDecoration removes <command> tags and code fence lines from a message,
+// leaving the commands and code themselves, e.g. to save a script as is
+func stripDecoration(content string) string {
+	content = replaceCommandTags(content, func(tag commandTag) string { return tag.text })
+	return fenceLineRe.ReplaceAllString(content, "")
+}
+
+// saveOutput writes command output to path, expanding a leading ~, and
+// returns the absolute path it was written to
+func saveOutput(path, output string) (string, error) {
+	absPath, err := expandPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(absPath, []byte(output), 0644); err != nil {
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+	return absPath, nil
+}
+
+// send adds content to the conversation as a user message and asks for the
+// response
+func (m *model) send(content string) tea.Cmd {
+	if m.config.TrimMessages {
+		content = trimMessage(content)
+	}
+	m.messages = append(m.messages, storage.Message{
+		Role:      "user",
+		Content:   content,
+		Timestamp: time.Now(),
+	})
+	m.conversation.Messages = m.messages
+	// The reply wouldn't be flagged yet, show everything again
+	m.flaggedOnly = false
+
+	cmd := m.streamResponse()
+	m.updateViewport()
+	m.viewport.GotoBottom()
+	return cmd
+}
+
+// trimMessage drops trailing whitespace from the lines of content and
+// squeezes runs of blank lines into one, leaving code blocks exactly as
+// they are
+func trimMessage(content string) string {
+	var lines []string
+	inFence := false
+	blank := 0
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+			blank = 0
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+			continue
+		}
+		if inFence {
+			lines = append(lines, line)
+			continue
+		}
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank++
+			if blank > 1 {
+				continue
+			}
+		} else {
+			blank = 0
+		}
+		lines = append(lines, line)
+	}
+	return strings.Trim(strings.Join(lines, "\n"), "\n")
+}
+
+// lastOutputCommand returns the command of the latest command output added to
+// messages
+func lastOutputCommand(messages []storage.Message) (string, bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		rest, ok := strings.CutPrefix(messages[i].Content, commandOutputPrefix)
+		if messages[i].Role == "assistant" && ok {
+			command, _, _ := strings.Cut(rest, "\nCommand result:")
+			return command, true
+		}
+	}
+	return "", false
+}
+
+// fenceCode wraps text in a fenced code block, using a longer fence if the
+// text has one of its own
+func fenceCode(text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + "\n" + text + "\n" + fence
+}
+
+// expandPath resolves a path typed by the user, which may start with "~/",
+// to an absolute one
+func expandPath(path string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("error getting home directory: %w", err)
+		}
+		path = filepath.Join(homeDir, rest)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("error resolving path: %w", err)
+	}
+	return absPath, nil
+}
+
+// commandDir returns the directory the open conversation's commands run in,
+// or "" for the one gpt-term was started in. If the conversation's directory
+// is gone that's an error, since running its commands anywhere else could
+// act on the wrong files.
+func (m model) commandDir() (string, error) {
+	if m.conversation.Dir == "" {
+		return "", nil
+	}
+	if info, err := os.Stat(m.conversation.Dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("working directory %s is gone, Alt+D to pick another", m.conversation.Dir)
+	}
+	return m.conversation.Dir, nil
+}
+
+// saveConversation saves conv, keeping it as a copy instead if another
+// gpt-term instance saved the same conversation in the meantime
+func (m *model) saveConversation(conv *storage.Conversation) {
+	err := m.storage.SaveConversation(conv)
+	var conflict *storage.ConflictError
+	if errors.As(err, &conflict) {
+		if err = m.storage.SaveAsCopy(conv); err == nil {
+			m.notice = "This conversation was changed in another window, saved yours as a copy"
+			return
+		}
+	}
+	if err != nil {
+		m.fail(err)
+	}
+}
+
+// newConversation creates an unsaved conversation from a template. The zero
+// template is the default shell helper.
+func newConversation(tmpl config.Template) *storage.Conversation {
+	prompt := tmpl.SystemPrompt
+	if prompt == "" {
+		prompt = personaPrompt(tmpl.Persona)
+	}
+
+	conv := &storage.Conversation{
+		ID:        uuid.New().String(),
+		CreatedAt: time.Now(),
+		Messages:  make([]storage.Message, 0),
+	}
+	if p, ok := persona.Find(tmpl.Persona); ok {
+		conv.Persona = p.Name
+	}
+	// Commands run where gpt-term was started, until changed with Alt+D
+	conv.Dir, _ = os.Getwd()
+	// Add system prompt as hidden message
+	conv.Messages = append(conv.Messages, storage.Message{
+		Role:      "system",
+		Content:   prompt,
+		Timestamp: time.Now(),
+	})
+	for _, msg := range tmpl.Messages {
+		conv.Messages = append(conv.Messages, storage.Message{
+			Role:      msg.Role,
+			Content:   msg.Content,
+			Timestamp: time.Now(),
+		})
+	}
+	return conv
+}
+
+const (
+	// maxContextFileBytes is the largest file a chat can be seeded with
+	maxContextFileBytes = 256 << 10
+	// contextWindow is how many tokens the models take in one request, to
+	// warn about context files that use up much of it
+	contextWindow = 200_000
+)
+
+// readContextFile reads a text file to seed a chat with, returning its
+// absolute path and a warning if it's big enough to make every request
+// noticeably more expensive
+func readContextFile(path string) (absPath, content, warning string, err error) {
+	absPath, err = expandPath(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error reading context file: %w", err)
+	}
+	if info.IsDir() {
+		return "", "", "", fmt.Errorf("%s is a directory", absPath)
+	}
+	if info.Size() > maxContextFileBytes {
+		return "", "", "", fmt.Errorf("%s is %d KB, context files can be at most %d KB", absPath, info.Size()>>10, maxContextFileBytes>>10)
+	}
+	data, err := os.ReadFile(absPath)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error reading context file: %w", err)
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return "", "", "", fmt.Errorf("%s doesn't look like a text file", absPath)
+	}
+
+	// About 4 characters a token
+	if tokens := len(data) / 4; tokens > contextWindow/10 {
+		warning = fmt.Sprintf("%s is about %s tokens, a big part of the %dk the model takes, and it's sent with every request",
+			filepath.Base(absPath), formatTokens(tokens), contextWindow/1000)
+	}
+	return absPath, string(data), warning, nil
+}
+
+// seedContext adds a file's content to the system prompt of conv, so every
+// request carries it even once context_messages drops older messages
+func seedContext(conv *storage.Conversation, path, content string) {
+	conv.Messages[0].Content += fmt.Sprintf("\n\nThe user is working with this file, %s:\n\n```\n%s\n```", path, strings.TrimRight(content, "\n"))
+	conv.ContextFile = path
+}
+
+// personaPrompt returns the system prompt of the built-in persona called name,
+// the shell helper's if there's none
+func personaPrompt(name string) string {
+	if p, ok := persona.Find(name); ok && p.SystemPrompt != "" {
+		return p.SystemPrompt
+	}
+	return systemPrompt
+}
+
+// pickTemplate lets the user pick a persona or template for a new chat,
+// starting on the default
+func (m *model) pickTemplate() {
+	m.mode = ModeTemplateSelect
+	m.selectedTemplate = 0
+	for i, p := range persona.Builtin {
+		if p.Name == m.config.Persona {
+			m.selectedTemplate = i
+		}
+	}
+	m.updateViewport()
+}
+
+// startConversation switches to a new conversation made from tmpl. The one
+// it replaces is saved first, and Alt+L goes back to it.
+func (m *model) startConversation(tmpl config.Template) {
+	m.mode = ModeNormal
+	left := m.conversation
+	if hasUserMessage(left) && !left.ReadOnly {
+		m.saveConversation(left)
+	}
+	m.openConversation(newConversation(tmpl))
+	if hasUserMessage(left) {
+		m.showToast("New chat started, Alt+L goes back to the last one", false)
+	}
+}
+
+// openConversation shows conv, remembering the one it replaces so Alt+L can
+// switch back to it
+func (m *model) openConversation(conv *storage.Conversation) {
+	conv = m.liveConversation(conv)
+	if m.conversation != nil && m.conversation.ID != conv.ID {
+		m.previousConvID = m.conversation.ID
+	}
+	m.conversation = conv
+	m.messages = conv.Messages
+	m.updateViewport()
+	m.viewport.GotoBottom()
+}
+
+// liveConversation returns the conversation with conv's ID that's open or
+// has a response streaming into it, or conv if there's none. A copy loaded
+// from disk would miss what streams in, and saving it later would look like
+// a conflict.
+func (m model) liveConversation(conv *storage.Conversation) *storage.Conversation {
+	for _, live := range []*storage.Conversation{m.conversation, m.streamConv} {
+		if live != nil && live.ID == conv.ID {
+			return live
+		}
+	}
+	return conv
+}
+
+// openMatching opens the conversation matching query at startup, the most
+// recent one if there are several
+func (m *model) openMatching(query string) error {
+	matches, err := m.storage.FindConversations(query)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no conversation matches %q", query)
+	}
+	conv, err := m.storage.LoadConversation(matches[0].ID)
+	if err != nil {
+		return err
+	}
+	m.conversation = conv
+	m.messages = conv.Messages
+	m.scrollToEnd = true
+	if len(matches) > 1 {
+		m.notice = fmt.Sprintf("%d conversations match %q, opened the most recent. Ctrl+R to pick another.", len(matches), query)
+	}
+	return nil
+}
+
+// switchToPrevious toggles between the open conversation and the one that
+// was open before it
+func (m *model) switchToPrevious() {
+	if m.previousConvID == "" {
+		m.notice = "No previous conversation to switch to"
+		return
+	}
+	conv := m.streamConv
+	if conv == nil || conv.ID != m.previousConvID {
+		loaded, err := m.storage.LoadConversation(m.previousConvID)
+		if err != nil {
+			// A new chat that was never sent anything isn't saved
+			m.notice = "The previous conversation was never saved"
+			return
+		}
+		conv = loaded
+	}
+	m.switchedFrom = m.conversation.Summary
+	if m.switchedFrom == "" {
+		m.switchedFrom = "new chat"
+	}
+	m.openConversation(conv)
+}
+
+// streamResponse sends the conversation to the API and streams the reply into
+// its last message. A new assistant message is appended to receive it, unless
+// the last message is already an incomplete reply that is being continued.
+func (m *model) streamResponse() tea.Cmd {
+	return m.streamWith(m.client)
+}
+
+// streamWith sends the conversation using client, so a request can go to
+// another model than the configured one
+func (m *model) streamWith(client *claude.Client) tea.Cmd {
+	claudeMsgs := toClaudeMessages(limitContext(m.messages, m.config.ContextMessages))
+	last := len(m.messages) - 1
+	if m.messages[last].Role == "assistant" {
+		// The API won't continue an assistant message ending in whitespace
+		m.messages[last].Content = strings.TrimRight(m.messages[last].Content, " \t\n")
+		m.messages[last].Truncated = ""
+		claudeMsgs[len(claudeMsgs)-1].Content = m.messages[last].Content
+	} else {
+		m.messages = append(m.messages, storage.Message{Role: "assistant", Timestamp: time.Now()})
+		m.conversation.Messages = m.messages
+	}
+
+	m.streamConv = m.conversation
+	m.streamIndex = len(m.messages) - 1
+	m.stopping = false
+	m.fallbackReason = ""
+	m.isLoading = true
+	m.following = m.config.AutoScroll
+
+	ch := make(chan tea.Msg)
+	m.streamCh = ch
+	ctx, cancel := context.WithCancel(context.Background())
+	m.streamCancel = cancel
+	m.retry = nil
+	respCache := m.cache
+	thinkingBudget := m.config.ThinkingBudget
+	params := m.requestParams(client)
+	return func() tea.Msg {
+		go func() {
+			// The key covers the system prompt too since it's one of the messages
+			var key string
+			if respCache != nil {
+				key, _ = cache.Key(params.Model, thinkingBudget, params.MaxTokens, params.Temperature, claudeMsgs)
+				if entry, ok := respCache.Get(key); ok {
+					if entry.Thinking != "" {
+						ch <- streamChunkMsg{text: entry.Thinking, thinking: true, stream: ch}
+					}
+					ch <- streamChunkMsg{text: entry.Text, stream: ch}
+					ch <- apiResponseMsg{response: entry.Text, stopReason: entry.StopReason, stream: ch, cached: true}
+					return
+				}
+			}
+
+			response, err := client.StreamMessage(ctx, claudeMsgs, params, claude.StreamHandler{
+				OnText: func(text string) {
+					ch <- streamChunkMsg{text: text, stream: ch}
+				},
+				OnThinking: func(thinking string) {
+					ch <- streamChunkMsg{text: thinking, thinking: true, stream: ch}
+				},
+				OnRetry: func(info claude.RetryInfo) {
+					ch <- retryMsg{info: info, stream: ch}
+				},
+			})
+			if respCache != nil && key != "" && err == nil {
+				respCache.Put(key, cache.Entry{
+					Text:       response.Text,
+					Thinking:   response.Thinking,
+					StopReason: response.StopReason,
+				})
+			}
+			ch <- apiResponseMsg{
+				response:   response.Text,
+				stopReason: response.StopReason,
+				usage:      response.Usage,
+				err:        err,
+				stream:     ch,
+			}
+		}()
+		return <-ch
+	}
+}
+
+// waitForStream delivers the next message from a response stream
+func waitForStream(ch chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		return <-ch
+	}
+}
+
+// requestParams are what a request in the open conversation is sent with
+// through client: the conversation's own settings over the config's. The
+// fallback client keeps its model.
+func (m model) requestParams(client *claude.Client) claude.Params {
+	params := claude.Params{Model: client.Model()}
+	settings := m.conversation.Settings
+	if settings == nil {
+		settings = &storage.Settings{}
+	}
+	if settings.Model != "" && client != m.fallbackClient {
+		params.Model = settings.Model
+	}
+	params.MaxTokens = m.config.MaxTokensFor(params.Model, m.conversation.Persona)
+	if settings.MaxTokens > 0 {
+		params.MaxTokens = settings.MaxTokens
+	}
+	params.Temperature = settings.Temperature
+	return params
+}
+
+// canFallback reports whether the last request in the open conversation failed
+// and can be sent again with the fallback model using Ctrl+F
+func (m model) canFallback() bool {
+	return m.fallbackClient != nil && m.fallbackReason != "" && !m.isLoading && m.streamConv == m.conversation &&
+		m.fallbackClient.Model() != m.requestParams(m.client).Model &&
+		len(m.messages) > 0 && m.messages[len(m.messages)-1].Role == "user"
+}
+
+// canResume reports whether the last response in the open conversation was
+// cut off and can be continued with Ctrl+G
+func (m model) canResume() bool {
+	return !m.isLoading && len(m.messages) > 0 &&
+		m.messages[len(m.messages)-1].Role == "assistant" && m.messages[len(m.messages)-1].Truncated != ""
+}
+
+// limitContext keeps the system prompt and the last limit messages of a
+// conversation. A limit of 0 keeps everything.
+func limitContext(messages []storage.Message, limit int) []storage.Message {
+	if limit <= 0 {
+		return messages
+	}
+
+	var system, rest []storage.Message
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			system = append(system, msg)
+		} else if msg.Role != dividerRole {
+			rest = append(rest, msg)
+		}
+	}
+	if len(rest) <= limit {
+		return messages
+	}
+
+	// The API wants the conversation to start with a user message
+	rest = rest[len(rest)-limit:]
+	for len(rest) > 1 && rest[0].Role != "user" {
+		rest = rest[1:]
+	}
+	return append(system, rest...)
+}
+
+// contextStatus describes how much of the conversation is being sent when
+// the context limit is cutting some of it off
+func (m model) contextStatus() string {
+	total := 0
+	for _, msg := range m.messages {
+		if msg.Role != "system" && msg.Role != dividerRole {
+			total++
+		}
+	}
+	if m.config.ContextMessages <= 0 || total <= m.config.ContextMessages {
+		return ""
+	}
+	return fmt.Sprintf("context: last %d of %d messages", m.config.ContextMessages, total)
+}
+
+// toClaudeMessages converts stored messages to the API format, leaving out
+// dividers
+func toClaudeMessages(messages []storage.Message) []claude.Message {
+	var claudeMsgs []claude.Message
+	for _, msg := range messages {
+		if msg.Role == dividerRole {
+			continue
+		}
+		claudeMsgs = append(claudeMsgs, claude.Message{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
+	}
+	return claudeMsgs
+}
+
+// editor returns the editor to use: the configured one, then $EDITOR, then nvim
+func (m model) editor() string {
+	if m.config.Editor != "" {
+		return m.config.Editor
+	}
+	return defaultEditor()
+}
+
+func defaultEditor() string {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "nvim" // fallback to nvim
+	}
+	return editor
+}
+
+// notesIndex is the editMessageMsg index of the conversation's notes, which
+// aren't a message
+const notesIndex = -1
+
+// editMessageCmd launches the user's preferred editor to edit the message content
+func editMessageCmd(editor, content string, index int) tea.Cmd {
+	tmpFile, err := os.CreateTemp("", "gpt-term-edit-*.txt")
+	if err != nil {
+		return func() tea.Msg {
+			return editMessageMsg{index: index, err: err}
+		}
+	}
+
+	if _, err := tmpFile.WriteString(content); err != nil {
+		return func() tea.Msg {
+			return editMessageMsg{index: index, err: err}
+		}
+	}
+	tmpFile.Close()
+
+	c := exec.Command(editor, tmpFile.Name())
+	return tea.ExecProcess(c, func(err error) tea.Msg {
+		defer os.Remove(tmpFile.Name())
+
+		if err != nil {
+			return editMessageMsg{index: index, err: err}
+		}
+
+		data, err := os.ReadFile(tmpFile.Name())
+		if err != nil {
+			return editMessageMsg{index: index, err: err}
+		}
+
+		return editMessageMsg{index: index, edited: string(data)}
+	})
+}
+
+func (m model) handleCommandExecution() (tea.Model, tea.Cmd) {
+	source := -1
+	var commands []command
+	if m.mode == ModeEditing {
+		if m.messages[m.cursorIndex].Role == "assistant" {
+			source = m.cursorIndex
+			commands = extractCommands(m.messages[source].Content, m.config.InlineCommands)
+		}
+	} else {
+		source, commands = m.latestCommands()
+	}
+
+	if len(commands) == 0 {
+		m.notice = "No commands to run"
+		return m, nil
+	}
+
+	// Always show command selection, even for single commands
+	m.mode = ModeCommandSelect
+	m.commands = commands
+	m.commandSource = source
+	m.selectedCommand = 0
+
+	return m, nil
+}
+
+// latestCommands finds the last assistant message with commands, skipping
+// command output, and returns its index and commands
+func (m model) latestCommands() (int, []command) {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].Role == "assistant" {
+			if commands := extractCommands(m.messages[i].Content, m.config.InlineCommands); len(commands) > 0 {
+				return i, commands
+			}
+		}
+	}
+	return -1, nil
+}
+
+// autoExecute runs the latest response's command without confirmation when
+// auto_execute is on, it's the only command and nothing stops it. Otherwise
+// the usual selection opens so the user decides.
+func (m model) autoExecute() (tea.Model, tea.Cmd) {
+	if !m.config.AutoExecute {
+		m.notice = "Set auto_execute in the config to run commands without confirming"
+		return m, nil
+	}
+
+	if cmd, ok := m.unconfirmedCommand(); ok {
+		return m, m.run(cmd)
+	}
+	return m.handleCommandExecution()
+}
+
+// unconfirmedCommand returns the latest response's command if it can run
+// without confirmation: it's the only one and nothing stops it. If it has to
+// be confirmed, the notice says why.
+func (m *model) unconfirmedCommand() (command, bool) {
+	_, commands := m.latestCommands()
+	if len(commands) != 1 || m.commandBlocked(commands[0]) {
+		return command{}, false
+	}
+	if commands[0].from == "list" {
+		m.notice = "Confirm this one, it was picked out of a list rather than tagged"
+		return command{}, false
+	}
+	if entry := denylisted(commands[0].text, m.config.Denylist); entry != "" {
+		m.notice = fmt.Sprintf("Confirm this one, it contains %q", entry)
+		return command{}, false
+	}
+	if found := placeholders(commands[0].text); len(found) > 0 {
+		m.notice = fmt.Sprintf("Confirm this one, %s has to be filled in", found[0])
+		return command{}, false
+	}
+	if name := unsetVariable(commands[0].text, commandEnv(m.config.CommandEnv)); name != "" && m.config.ExpansionWarnings {
+		m.notice = fmt.Sprintf("Confirm this one, $%s isn't set", name)
+		return command{}, false
+	}
+	return commands[0], true
+}
+
+// nextMacroStep runs the next action of the running macro. Sending a request
+// or running a command finishes later, Update goes on with the macro then.
+// When an action can't be done the rest of the macro is dropped.
+func (m model) nextMacroStep() (tea.Model, tea.Cmd) {
+	if len(m.macro) == 0 {
+		return m, nil
+	}
+	action := m.macro[0]
+	m.macro = m.macro[1:]
+	stop := func(notice string) (tea.Model, tea.Cmd) {
+		m.macro = nil
+		if notice != "" {
+			m.notice = "Macro stopped: " + notice
+		}
+		return m, nil
+	}
+	if m.mode != ModeNormal {
+		return stop("left the conversation view")
+	}
+
+	switch action {
+	case "send":
+		if m.textInput.Value() == "" {
+			return stop("nothing to send")
+		}
+		// Binding send to a key is confirmation enough
+		m.staged = true
+		updated, cmd := m.update(tea.KeyMsg{Type: tea.KeyEnter})
+		next := updated.(model)
+		next.macroWaiting = next.isLoading
+		return next, cmd
+	case "execute":
+		// Like Alt+X, commands only run unconfirmed with auto_execute on
+		if !m.config.AutoExecute {
+			m.macro = nil
+			m.notice = "Macro stopped: confirm the command, or set auto_execute to run it unconfirmed"
+			return m.handleCommandExecution()
+		}
+		cmd, ok := m.unconfirmedCommand()
+		if !ok {
+			// Let the user decide, the macro can't go on without them
+			m.macro = nil
+			return m.handleCommandExecution()
+		}
+		m.macroWaiting = true
+		return m, m.run(cmd)
+	case "regenerate":
+		if m.conversation.ReadOnly {
+			return stop("the conversation is read-only")
+		}
+		last := len(m.messages) - 1
+		if last < 1 || m.messages[last].Role != "assistant" || m.messages[last-1].Role != "user" {
+			return stop("no response to regenerate")
+		}
+		m.messages = m.messages[:last]
+		m.conversation.Messages = m.messages
+		m.macroWaiting = true
+		cmd := m.streamResponse()
+		m.updateViewport()
+		m.viewport.GotoBottom()
+		return m, cmd
+	case "copy-output":
+		if m.lastCommand == "" {
+			return stop("no command output to copy")
+		}
+		copyCmd := copyToClipboard(m.lastOutput, "command output")
+		updated, cmd := m.nextMacroStep()
+		return updated, tea.Batch(copyCmd, cmd)
+	case "follow-up":
+		command, ok := lastOutputCommand(m.messages)
+		if !ok {
+			return stop("no command output to follow up on")
+		}
+		if m.conversation.ReadOnly {
+			return stop("the conversation is read-only")
+		}
+		m.macroWaiting = true
+		return m, m.send(explain.OutputPrompt(command))
+	}
+	return stop("unknown action " + action)
+}
+
+// denylisted returns the first denylist entry found at the start of a word in
+// cmdStr, ignoring differences in spacing, or "" if there's none
+func denylisted(cmdStr string, denylist []string) string {
+	normalized := " " + strings.Join(strings.Fields(cmdStr), " ") + " "
+	for _, entry := range denylist {
+		if strings.Contains(normalized, " "+strings.Join(strings.Fields(entry), " ")) {
+			return entry
+		}
+	}
+	return ""
+}
+
+// messageNumber is the position of the message at index in the conversation
+// as the user sees it, not counting the system prompt
+func (m model) messageNumber(index int) int {
+	n := 0
+	for _, msg := range m.messages[:index+1] {
+		if msg.Role != "system" {
+			n++
+		}
+	}
+	return n
+}
+
+// commandOverlayTitle says which message the listed commands come from
+func (m model) commandOverlayTitle() string {
+	if m.commandSource < 0 {
+		return "Run the last command again:\n\n"
+	}
+	where := fmt.Sprintf("message %d", m.messageNumber(m.commandSource))
+	for i := len(m.messages) - 1; i > m.commandSource; i-- {
+		if m.messages[i].Role == "assistant" {
+			return "Select a command to execute or copy, from " + where + ":\n\n"
+		}
+	}
+	return "Select a command to execute or copy, from " + where + " (latest response):\n\n"
+}
+
+// explainSelected looks up an explanation of the selected command when
+// explanations are shown. Common commands are explained locally, anything
+// else is sent to the model.
+func (m *model) explainSelected() tea.Cmd {
+	if !m.showExplanation || len(m.commands) == 0 {
+		return nil
+	}
+	cmdStr := m.commands[m.selectedCommand].text
+	if _, ok := m.explanations[cmdStr]; ok {
+		return nil
+	}
+	if text, ok := explain.Local(cmdStr); ok {
+		m.explanations[cmdStr] = text
+		return nil
+	}
+
+	// An empty entry marks the request as in flight
+	m.explanations[cmdStr] = ""
+	client := m.client
+	return func() tea.Msg {
+		text, err := client.CreateMessage([]claude.Message{{Role: "user", Content: explain.Prompt(cmdStr)}})
+		return explanationMsg{command: cmdStr, text: text, err: err}
+	}
+}
+
+// summaryPrompt asks the model for a title when the user's messages don't say
+// what the conversation is about
+const summaryPrompt = "Write a title of at most six words for the conversation below. Reply with only the title, no quotes.\n\n"
+
+// summarizeCmd asks the model for a summary of conv from its first messages,
+// or from its latest ones for a fresh summary of where it's at now
+func summarizeCmd(client *claude.Client, conv *storage.Conversation, fresh bool) tea.Cmd {
+	var entries []string
+	size := 0
+	for i := range conv.Messages {
+		msg := conv.Messages[i]
+		if fresh {
+			msg = conv.Messages[len(conv.Messages)-1-i]
+		}
+		if msg.Role != "user" && msg.Role != "assistant" {
+			continue
+		}
+		content := msg.Content
+		if len(content) > 500 {
+			content = content[:500] + "…"
+		}
+		entries = append(entries, msg.Role+": "+content+"\n\n")
+		size += len(entries[len(entries)-1])
+		if size > 2000 {
+			break
+		}
+	}
+	if fresh {
+		slices.Reverse(entries)
+	}
+	prompt := summaryPrompt + strings.Join(entries, "")
+	return func() tea.Msg {
+		text, err := client.CreateMessage([]claude.Message{{Role: "user", Content: prompt}})
+		return summaryMsg{conv: conv, summary: text, err: err, fresh: fresh}
+	}
+}
+
+// cleanSummary makes a model's reply fit as a summary
+func cleanSummary(text string) string {
+	text, _, _ = strings.Cut(strings.TrimSpace(text), "\n")
+	text = strings.Trim(strings.TrimSpace(text), `"'`+"`")
+	if len(text) > 50 {
+		text = text[:47] + "..."
+	}
+	return text
+}
+
+// stripANSI removes terminal escape sequences from command output. Progress
+// bars that redraw a line with carriage returns are reduced to their final state.
+func stripANSI(s string) string {
+	ansiRe := regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+	s = ansiRe.ReplaceAllString(s, "")
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if idx := strings.LastIndex(line, "\r"); idx != -1 {
+			line = line[idx+1:]
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pathRe finds file paths: absolute ones, ones starting with ~, ./ or ../,
+// and relative ones like src/main.go that end in an extension. The first
+// group is what comes before a path, so words like and/or aren't matched.
+var pathRe = regexp.MustCompile(`(^|[\s"'(\[=` + "`" + `])((?:~|\.{1,2})?/[\w.@+\-]+(?:/[\w.@+\-]+)*/?|[\w\-]+(?:/[\w.@+\-]+)+\.[A-Za-z0-9]+)`)
+
+// tableRowRe matches a line of a markdown table
+var tableRowRe = regexp.MustCompile(`(?m)^[ \t]*\|.*$`)
+
+// pathSpans returns where the paths in content are, without punctuation that
+// ends a sentence. Ones in <command> tags, code blocks and tables are left
+// out, since marking them would change the code or throw off the columns.
+func pathSpans(content string) [][2]int {
+	var skipped [][2]int
+	for _, cmd := range commandTags(content) {
+		skipped = append(skipped, [2]int{cmd.start, cmd.end})
+	}
+	for _, span := range codeFenceRe.FindAllStringIndex(content, -1) {
+		skipped = append(skipped, [2]int{span[0], span[1]})
+	}
+	for _, span := range tableRowRe.FindAllStringIndex(content, -1) {
+		skipped = append(skipped, [2]int{span[0], span[1]})
+	}
+
+	var spans [][2]int
+	for _, match := range pathRe.FindAllStringSubmatchIndex(content, -1) {
+		start, end := match[4], match[5]
+		for end > start && strings.ContainsRune(".,:;", rune(content[end-1])) {
+			end--
+		}
+		inSkipped := false
+		for _, span := range skipped {
+			inSkipped = inSkipped || (start >= span[0] && start < span[1])
+		}
+		if !inSkipped && end-start > 1 {
+			spans = append(spans, [2]int{start, end})
+		}
+	}
+	return spans
+}
+
+// extractPaths returns the distinct paths in content, in the order they're
+// numbered when shown
+func extractPaths(content string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, span := range pathSpans(content) {
+		path := content[span[0]:span[1]]
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// markPaths styles the paths in content and numbers them, so Alt+P can open
+// one by its number
+func markPaths(content string) string {
+	paths := extractPaths(content)
+	var s strings.Builder
+	last := 0
+	for _, span := range pathSpans(content) {
+		path := content[span[0]:span[1]]
+		n := slices.Index(paths, path) + 1
+		s.WriteString(content[last:span[0]])
+		s.WriteString(pathStyle.Render(path) + pathNumberStyle.Render(fmt.Sprintf("[%d]", n)))
+		last = span[1]
+	}
+	s.WriteString(content[last:])
+	return s.String()
+}
+
+// choosePath opens the path in the message at index, asking which one when
+// there are several
+func (m *model) choosePath(index int) tea.Cmd {
+	m.paths = extractPaths(m.messages[index].Content)
+	switch len(m.paths) {
+	case 0:
+		m.notice = "No paths in this message"
+		return nil
+	case 1:
+		return m.openPath(m.paths[0])
+	}
+	return m.startPrompt(fmt.Sprintf("Open path (1-%d):", len(m.paths)), "", promptOpenPath)
+}
+
+// openPath opens a file in the editor, or a directory with the OS file
+// opener. Relative paths are taken from where the conversation's commands run.
+func (m *model) openPath(path string) tea.Cmd {
+	if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "~") {
+		dir, err := m.commandDir()
+		if err != nil {
+			m.notice = err.Error()
+			return nil
+		}
+		if dir != "" {
+			path = filepath.Join(dir, path)
+		}
+	}
+	absPath, err := expandPath(path)
+	if err != nil {
+		m.fail(err)
+		return nil
+	}
+
+	info, err := os.Stat(absPath)
+	if err == nil && info.IsDir() {
+		cmd, err := getOpenCommand(absPath)
+		if err != nil {
+			m.fail(err)
+			return nil
+		}
+		return func() tea.Msg {
+			return pathOpenedMsg{path: absPath, err: cmd.Start()}
+		}
+	}
+	// A file that doesn't exist yet is created by the editor, as long as
+	// its directory is there
+	if _, err := os.Stat(filepath.Dir(absPath)); err != nil {
+		m.notice = absPath + " doesn't exist"
+		return nil
+	}
+	return tea.ExecProcess(exec.Command(m.editor(), absPath), func(err error) tea.Msg {
+		return pathOpenedMsg{path: absPath, err: err}
+	})
+}
+
+// extractCommands returns the <command> tagged commands in content, followed by
+// the lines of any shell code fences the model used instead of the tags and,
+// with inline on, commands written inline in lists
+func extractCommands(content string, inline bool) []command {
+	var commands []command
+	seen := make(map[string]bool)
+
+	for _, cmd := range taggedCommands(content) {
+		commands = append(commands, command{text: cmd})
+		seen[cmd] = true
+	}
+
+	fenceRe := regexp.MustCompile("(?s)```(bash|sh|shell|zsh|console)[ \t]*\n(.*?)```")
+	for _, match := range fenceRe.FindAllStringSubmatch(content, -1) {
+		for _, line := range fencedCommandLines(match[2], match[1] == "console") {
+			if seen[line] {
+				continue
+			}
+			commands = append(commands, command{text: line, from: "code block"})
+			seen[line] = true
+		}
+	}
+
+	if inline {
+		for _, cmd := range listCommands(content) {
+			if !seen[cmd] {
+				commands = append(commands, command{text: cmd, from: "list"})
+				seen[cmd] = true
+			}
+		}
+	}
+
+	return commands
+}
+
+var (
+	codeFenceRe  = regexp.MustCompile("(?s)```.*?```")
+	listItemRe   = regexp.MustCompile(`(?m)^[ \t]*(?:\d+[.)]|[-*+])[ \t]+(.+)$`)
+	inlineCodeRe = regexp.MustCompile("`([^`\n]+)`")
+)
+
+// listCommands returns the inline code in numbered and bulleted list items
+// that looks like a shell command: a program on the PATH followed by
+// arguments. A lone word like `git` is usually just a name, so it's skipped.
+func listCommands(content string) []string {
+	var commands []string
+	content = codeFenceRe.ReplaceAllString(content, "")
+	for _, item := range listItemRe.FindAllStringSubmatch(content, -1) {
+		for _, code := range inlineCodeRe.FindAllStringSubmatch(item[1], -1) {
+			cmd := strings.TrimPrefix(strings.TrimSpace(code[1]), "$ ")
+			fields := strings.Fields(cmd)
+			if len(fields) < 2 {
+				continue
+			}
+			program := fields[0]
+			if program == "sudo" {
+				program = fields[1]
+			}
+			if _, err := exec.LookPath(program); err == nil {
+				commands = append(commands, cmd)
+			}
+		}
+	}
+	return commands
+}
+
+// fencedCommandLines splits the body of a shell code fence into commands,
+// skipping comments and prompts. Backslash continuations are joined, and a
+// loop, if, case, { } group, heredoc or line ending in a pipe is kept whole
+// with the lines it runs on. In a console session only the lines after a $
+// prompt are commands, the rest is their output.
+func fencedCommandLines(code string, console bool) []string {
+	var commands []string
+	var current strings.Builder
+	var depth int
+	var heredoc string
+	for _, line := range strings.Split(code, "\n") {
+		if heredoc != "" {
+			current.WriteString("\n" + line)
+			if strings.TrimSpace(line) != heredoc {
+				continue
+			}
+			heredoc = ""
+		} else {
+			line = strings.TrimSpace(line)
+			if current.Len() == 0 {
+				if console && !strings.HasPrefix(line, "$ ") {
+					continue
+				}
+				if line == "" || strings.HasPrefix(line, "#") || strings.Contains(line, "<command>") {
+					continue
+				}
+				line = strings.TrimPrefix(line, "$ ")
+			} else {
+				if console {
+					line = strings.TrimPrefix(line, "> ")
+				}
+				if !strings.HasSuffix(current.String(), " ") {
+					current.WriteString("\n")
+				}
+			}
+
+			depth += blockDepth(line)
+			if match := heredocRe.FindStringSubmatch(line); match != nil {
+				heredoc = match[1]
+			}
+			if strings.HasSuffix(line, "\\") {
+				current.WriteString(strings.TrimSpace(strings.TrimSuffix(line, "\\")) + " ")
+				continue
+			}
+			current.WriteString(line)
+			if heredoc != "" || depth > 0 || pipeContinuedRe.MatchString(line) {
+				continue
+			}
+		}
+		if depth > 0 {
+			continue
+		}
+
+		commands = append(commands, strings.TrimSpace(current.String()))
+		current.Reset()
+		depth = 0
+	}
+	if current.Len() > 0 {
+		commands = append(commands, strings.TrimSpace(current.String()))
+	}
+	return commands
+}
+
+var (
+	// heredocRe matches the start of a heredoc, capturing the word that ends it
+	heredocRe = regexp.MustCompile(`(?:^|[^<])<<-?[ \t]*['"]?([A-Za-z_][A-Za-z0-9_]*)['"]?`)
+	// pipeContinuedRe matches a line that goes on to the next one
+	pipeContinuedRe = regexp.MustCompile(`(?:\||&&)\s*$`)
+	// statementSepRe splits a line into the simple commands in it
+	statementSepRe = regexp.MustCompile(`;;?|&&|\|\||[|&]`)
+)
+
+// blockDepth returns how many compound statements line opens, less the ones
+// it closes
+func blockDepth(line string) int {
+	depth := 0
+	for _, statement := range statementSepRe.Split(line, -1) {
+		fields := strings.Fields(statement)
+		for _, field := range fields {
+			switch field {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+		}
+		// Keywords only count where a command would start
+		for len(fields) > 0 {
+			switch fields[0] {
+			case "if", "case", "for", "while", "until", "select":
+				depth++
+			case "fi", "esac", "done":
+				depth--
+			}
+			if !slices.Contains([]string{"then", "do", "else", "elif", "!", "time"}, fields[0]) {
+				break
+			}
+			fields = fields[1:]
+		}
+	}
+	return depth
+}
+
+// commandLabel renders a line of the command selection list, marking the
+// commands that were found in a code fence or list rather than tagged by the model
+// and the ones the sandbox won't run
+func (m model) commandLabel(line string, cmd command, selected bool) string {
+	var tags string
+	if cmd.from != "" {
+		tags += " " + scrollIndicatorStyle.Render("[from "+cmd.from+"]")
+	}
+	if m.commandBlocked(cmd) {
+		tags += " " + blockedStyle.Render("[blocked by sandbox]")
+	}
+
+	// Fit the command next to its tags inside the overlay's border and
+	// padding, on one line or wrapped
+	width := m.viewport.Width - overlayStyle.GetHorizontalFrameSize() - lipgloss.Width(tags)
+	if m.config.TruncateCommands {
+		line = truncateLine(line, width)
+	} else if width > 0 && lipgloss.Width(line) > width {
+		line = lipgloss.NewStyle().Width(width).Render(line)
+	}
+	if selected {
+		line = selectedStyle.Render(line)
+	}
+	return line + tags
+}
+
+// truncateLine puts s on a single line, cutting it off with "…" if it's
+// wider than width
+func truncateLine(s string, width int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if width <= 0 || lipgloss.Width(s) <= width {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && lipgloss.Width(string(runes)) >= width {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "…"
+}
+
+// runCommand executes the command at index in the selection list unless the
+// sandbox blocks it, in which case the list stays open with it selected
+func (m model) runCommand(index int) (tea.Model, tea.Cmd) {
+	if m.commandBlocked(m.commands[index]) {
+		m.selectedCommand = index
+		return m, nil
+	}
+	if found := placeholders(m.commands[index].text); len(found) > 0 && !m.commands[index].filled {
+		m.selectedCommand = index
+		return m, m.fillPlaceholders(m.commands[index], found, false)
+	}
+	m.mode = ModeNormal
+	return m, m.run(m.commands[index])
+}
+
+// fillPlaceholders asks for a value for each placeholder in cmd before it's
+// run, so a literal <filename> isn't passed to the shell
+func (m *model) fillPlaceholders(cmd command, found []string, live bool) tea.Cmd {
+	m.filling = &cmd
+	m.fillingLive = live
+	m.fillQueue = found
+	return m.startPrompt(fmt.Sprintf("Value for %s:", found[0]), "", promptPlaceholder)
+}
+
+// fillPlaceholder puts value in place of the next placeholder, then asks for
+// the one after it. Once they're all filled in the command is shown in the
+// selection again to be confirmed. An empty value keeps the text as written,
+// for when it wasn't a placeholder after all.
+func (m *model) fillPlaceholder(value string) tea.Cmd {
+	if value != "" {
+		m.filling.text = fillPlaceholderText(m.filling.text, m.fillQueue[0], value)
+	}
+	m.fillQueue = m.fillQueue[1:]
+	if len(m.fillQueue) > 0 {
+		return m.startPrompt(fmt.Sprintf("Value for %s:", m.fillQueue[0]), "", promptPlaceholder)
+	}
+
+	// The values change what the command does, so it's run only once the
+	// user has seen it with them
+	cmd := *m.filling
+	cmd.filled = true
+	m.filling = nil
+	m.commands[m.selectedCommand] = cmd
+	if m.fillingLive {
+		m.notice = "Check the filled-in command, L runs it live"
+	} else {
+		m.notice = "Check the filled-in command, Enter runs it"
+	}
+	return nil
+}
+
+// shell returns the program and flags the open conversation's commands run
+// with, which depends on its persona
+func (m model) shell() []string {
+	if p, ok := persona.Find(m.conversation.Persona); ok && p.Shell != nil {
+		return p.Shell
+	}
+	return []string{commandShell, "-c"}
+}
+
+// run executes cmd in the conversation's directory and remembers it for Alt+R.
+// It refuses when that directory is gone, stopping a macro waiting on it.
+func (m *model) run(cmd command) tea.Cmd {
+	dir, err := m.commandDir()
+	if err != nil {
+		m.notice = err.Error()
+		m.macro = nil
+		m.macroWaiting = false
+		return nil
+	}
+	m.lastRun = &cmd
+	return executeCommand(m.shell(), cmd.text, dir, commandEnv(m.config.CommandEnv), m.config.MaxOutputMB)
+}
+
+// runLive starts a command whose output is sent to the model every
+// live_feed_seconds while it runs, so the model can react as it goes
+func (m model) runLive(index int) (tea.Model, tea.Cmd) {
+	switch {
+	case m.config.LiveFeedSeconds <= 0:
+		m.notice = "Set live_feed_seconds in the config to run commands live"
+		return m, nil
+	case m.live != nil:
+		m.notice = "A live command is already running, Esc stops it"
+		return m, nil
+	case m.readOnly():
+		return m, nil
+	case m.commandBlocked(m.commands[index]):
+		m.selectedCommand = index
+		return m, nil
+	}
+	if found := placeholders(m.commands[index].text); len(found) > 0 && !m.commands[index].filled {
+		m.selectedCommand = index
+		return m, m.fillPlaceholders(m.commands[index], found, true)
+	}
+
+	dir, err := m.commandDir()
+	if err != nil {
+		m.notice = err.Error()
+		return m, nil
+	}
+	cmd := m.commands[index]
+	live, err := livecmd.Start(m.shell(), cmd.text, dir, commandEnv(m.config.CommandEnv), m.config.MaxOutputMB<<20)
+	if err != nil {
+		m.fail(err)
+		return m, nil
+	}
+	m.mode = ModeNormal
+	m.lastRun = &cmd
+	m.live = live
+	m.liveConv = m.conversation.ID
+	m.liveFed = time.Now()
+	return m, liveTick(live)
+}
+
+func liveTick(live *livecmd.Command) tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return liveTickMsg{live: live} })
+}
+
+// feedLive sends the live command's new output to the model once the interval
+// has passed, and its last output when it finishes. Nothing is sent while a
+// response is still coming in or another conversation is open, the output
+// keeps until then.
+func (m model) feedLive() (tea.Model, tea.Cmd) {
+	interval := time.Duration(m.config.LiveFeedSeconds) * time.Second
+	due := m.live.Done() || (m.live.Pending() && time.Since(m.liveFed) >= interval)
+	if !due || m.isLoading || m.conversation.ID != m.liveConv {
+		return m, liveTick(m.live)
+	}
+
+	output, skipped, done, err := m.live.Next(liveChunkBytes)
+	if m.config.StripANSI {
+		output = stripANSI(output)
+	}
+	var prompt strings.Builder
+	if done {
+		status := "successfully"
+		if err != nil {
+			status = "with an error: " + err.Error()
+		}
+		fmt.Fprintf(&prompt, "The command `%s` finished %s. Its output since the last update:\n", m.live.Text, status)
+	} else {
+		fmt.Fprintf(&prompt, "The command `%s` is still running. Its output since the last update:\n", m.live.Text)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(&prompt, "(%d earlier bytes left out)\n", skipped)
+	}
+	prompt.WriteString(fenceCode(output) + "\n")
+	if done {
+		prompt.WriteString("Sum up how it went and what to do next, if anything.")
+	} else {
+		prompt.WriteString("Briefly point out anything that needs attention, or just say it looks fine.")
+	}
+
+	m.liveFed = time.Now()
+	cmd := m.send(prompt.String())
+	if done {
+		m.live = nil
+		return m, cmd
+	}
+	return m, tea.Batch(cmd, liveTick(m.live))
+}
+
+// rerun runs the last command again right away, unless the denylist or the
+// sandbox means it has to be confirmed in the selection
+func (m model) rerun() (tea.Model, tea.Cmd) {
+	if m.lastRun == nil {
+		m.notice = "No command has been run yet"
+		return m, nil
+	}
+	cmd := *m.lastRun
+	if m.commandBlocked(cmd) || denylisted(cmd.text, m.config.Denylist) != "" {
+		m.mode = ModeCommandSelect
+		m.commands = []command{cmd}
+		m.commandSource = -1
+		m.selectedCommand = 0
+		return m, nil
+	}
+	m.showToast("Running again: "+cmd.text, false)
+	return m, m.run(cmd)
+}
 
-		// Generate summary from first user message if not already set
-		if m.conversation.Summary == "" {
-			for _, msg := range m.messages {
-				if msg.Role == "user" {
-					summary := msg.Content
-					if len(summary) > 50 {
-						summary = summary[:47] + "..."
-					}
-					m.conversation.Summary = summary
-					break
-				}
-			}
-		}
+// commandBlocked reports whether sandbox mode is on and cmd isn't allowlisted
+func (m model) commandBlocked(cmd command) bool {
+	return m.config.Sandbox.Enabled && !sandboxAllows(cmd.text, m.config.Sandbox.Allowlist)
+}
 
-		if err := m.storage.SaveConversation(m.conversation); err != nil {
-			m.err = err
+// sandboxAllows reports whether every command in a pipeline or list starts
+// with an allowlisted program. Redirects and substitutions are never allowed
+// since they can write files or run arbitrary programs.
+func sandboxAllows(cmdStr string, allowlist []string) bool {
+	if strings.ContainsAny(cmdStr, ">`") {
+		return false
+	}
+	for _, subst := range []string{"$(", "<(", ">("} {
+		if strings.Contains(cmdStr, subst) {
+			return false
 		}
+	}
 
-		// Update viewport with new content
-		m.updateViewport()
-		m.viewport.GotoBottom()
+	allowed := make(map[string]bool)
+	for _, name := range allowlist {
+		allowed[name] = true
+	}
 
-	case editMessageMsg:
-		if msg.err != nil {
-			m.err = msg.err
-			return m, nil
+	splitRe := regexp.MustCompile(`\|\||&&|[|;&\n]`)
+	for _, part := range splitRe.Split(cmdStr, -1) {
+		fields := strings.Fields(part)
+		if len(fields) > 0 && !allowed[fields[0]] {
+			return false
 		}
-		m.messages[msg.index].Content = msg.edited
-		m.messages = m.messages[:msg.index+1]
-		m.conversation.Messages = m.messages
-		m.updateViewport()
-		m.viewport.GotoBottom()
+	}
+	return true
+}
 
-		// Regenerate summary if first user message was edited
-		for _, msg := range m.messages {
-			if msg.Role == "user" {
-				summary := msg.Content
-				if len(summary) > 50 {
-					summary = summary[:47] + "..."
-				}
-				m.conversation.Summary = summary
-				break
-			}
-		}
+var (
+	singleQuotedRe = regexp.MustCompile(`'[^']*'`)
+	variableRe     = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+	assignedRe     = regexp.MustCompile(`(?:^|[\s;&|(])(?:export\s+)?([A-Za-z_][A-Za-z0-9_]*)=|\b(?:for|read|select)\s+([A-Za-z_][A-Za-z0-9_]*)`)
+)
 
-		if err := m.storage.SaveConversation(m.conversation); err != nil {
-			m.err = err
+// placeholderRe matches the usual ways the model marks a value the user has
+// to fill in: <filename>, YOUR_IP and positional parameters like $1
+var placeholderRe = regexp.MustCompile(`<[A-Za-z][\w.-]*(?: [\w.-]+)*>|\b(?:YOUR|MY)_[A-Z0-9_]+\b|\$[1-9]\b`)
+
+// redirectTargetRe matches the start of a file or descriptor a redirect
+// writes to
+var redirectTargetRe = regexp.MustCompile(`^[\w~$&]`)
+
+// placeholders returns the distinct placeholders in cmdStr in the order they
+// appear
+func placeholders(cmdStr string) []string {
+	var found []string
+	for _, span := range placeholderSpans(cmdStr) {
+		if match := cmdStr[span[0]:span[1]]; !slices.Contains(found, match) {
+			found = append(found, match)
 		}
-		m.mode = ModeNormal
+	}
+	return found
+}
 
-		// Convert messages to Claude format and send request
-		var claudeMsgs []claude.Message
-		for _, msg := range m.messages {
-			claudeMsgs = append(claudeMsgs, claude.Message{
-				Role:    msg.Role,
-				Content: msg.Content,
-			})
+// placeholderSpans returns where the placeholders in cmdStr are. Single-quoted
+// text belongs to awk, sed and the like, so it's left alone, as is
+// <in.txt>out.txt where < and > are redirects.
+func placeholderSpans(cmdStr string) [][2]int {
+	var spans [][2]int
+	for _, span := range placeholderRe.FindAllStringIndex(cmdStr, -1) {
+		if quoteAt(cmdStr, span[0]) == '\'' {
+			continue
 		}
-
-		m.isLoading = true
-		return m, func() tea.Msg {
-			response, err := m.client.CreateMessage(claudeMsgs)
-			return apiResponseMsg{response: response, err: err}
+		// A word right after the > is what's being redirected into
+		if cmdStr[span[0]] == '<' && span[1] < len(cmdStr) && redirectTargetRe.MatchString(cmdStr[span[1]:]) {
+			continue
 		}
+		spans = append(spans, [2]int{span[0], span[1]})
+	}
+	return spans
+}
 
-	case commandOutputMsg:
-		if msg.err != nil {
-			m.err = msg.err
-			return m, nil
+// fillPlaceholderText puts value in place of placeholder in cmdStr, quoted so
+// the shell takes it as is, even with spaces, quotes or a ;
+func fillPlaceholderText(cmdStr, placeholder, value string) string {
+	spans := placeholderSpans(cmdStr)
+	for i := len(spans) - 1; i >= 0; i-- {
+		start, end := spans[i][0], spans[i][1]
+		if cmdStr[start:end] != placeholder {
+			continue
 		}
-		// Add command output as assistant message
-		botMsg := storage.Message{
-			Role:      "assistant",
-			Content:   "```\n" + msg.output + "```",
-			Timestamp: time.Now(),
+		quoted := shellQuote(value)
+		if quoteAt(cmdStr, start) == '"' {
+			quoted = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value)
 		}
-		m.messages = append(m.messages, botMsg)
-		m.conversation.Messages = m.messages
-		if err := m.storage.SaveConversation(m.conversation); err != nil {
-			m.err = err
+		cmdStr = cmdStr[:start] + quoted + cmdStr[end:]
+	}
+	return cmdStr
+}
+
+// quoteAt returns the shell quote, ' or ", that pos in s is inside of, or 0
+func quoteAt(s string, pos int) byte {
+	var quote byte
+	for i := 0; i < pos && i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quote != '\'':
+			i++ // Skip what's escaped
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
 		}
+	}
+	return quote
+}
 
-		// Update viewport with new content and scroll to bottom
-		m.updateViewport()
-		m.viewport.GotoBottom()
-		return m, nil
+// expansion is a variable the shell will expand in a command
+type expansion struct {
+	name  string
+	value string
+	set   bool
+}
 
-	case scrollMsg:
-		m.viewport.YOffset = msg.offset
-		fmt.Fprintf(os.Stderr, "DEBUG: Applied scroll offset: %d\n", msg.offset)
-		return m, nil
+// commandExpansions finds what the shell expands in cmdStr: the variables it
+// references, other than ones the command sets itself, and whether it runs
+// command substitutions. Single-quoted text isn't expanded, so it's skipped.
+// Variables are looked up in env, the environment the command runs with, or
+// gpt-term's if it's nil like commandEnv returns without command_env.
+func commandExpansions(cmdStr string, env []string) ([]expansion, bool) {
+	unquoted := singleQuotedRe.ReplaceAllString(cmdStr, "")
+
+	assigned := make(map[string]bool)
+	for _, match := range assignedRe.FindAllStringSubmatch(unquoted, -1) {
+		assigned[match[1]+match[2]] = true
 	}
 
-	return m, tea.Batch(cmds...)
+	var vars []expansion
+	seen := make(map[string]bool)
+	for _, match := range variableRe.FindAllStringSubmatch(unquoted, -1) {
+		name := match[1]
+		if seen[name] || assigned[name] {
+			continue
+		}
+		seen[name] = true
+		value, set := lookupEnv(env, name)
+		vars = append(vars, expansion{name: name, value: value, set: set})
+	}
+
+	substitutes := strings.Contains(unquoted, "$(") || strings.Contains(unquoted, "`")
+	return vars, substitutes
 }
 
-// editMessageCmd launches the user's preferred editor ($EDITOR) to edit the message content
-func editMessageCmd(content string, index int) tea.Cmd {
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = "nvim" // fallback to nvim
+// lookupEnv returns the value of the variable name in env, where a later
+// entry wins like it does for the command, or in gpt-term's environment if env
+// is nil
+func lookupEnv(env []string, name string) (string, bool) {
+	if env == nil {
+		return os.LookupEnv(name)
 	}
-
-	tmpFile, err := os.CreateTemp("", "gpt-term-edit-*.txt")
-	if err != nil {
-		return func() tea.Msg {
-			return editMessageMsg{index: index, err: err}
+	for i := len(env) - 1; i >= 0; i-- {
+		if value, ok := strings.CutPrefix(env[i], name+"="); ok {
+			return value, true
 		}
 	}
+	return "", false
+}
 
-	if _, err := tmpFile.WriteString(content); err != nil {
-		return func() tea.Msg {
-			return editMessageMsg{index: index, err: err}
+// expansionsView lists what the shell will expand in cmdStr when run with env,
+// flagging variables that aren't set
+func expansionsView(cmdStr string, env []string) string {
+	vars, substitutes := commandExpansions(cmdStr, env)
+	var lines []string
+	for _, v := range vars {
+		if v.set {
+			lines = append(lines, scrollIndicatorStyle.Render(fmt.Sprintf("$%s = %s", v.name, v.value)))
+		} else {
+			lines = append(lines, blockedStyle.Render(fmt.Sprintf("$%s is not set and will be empty", v.name)))
 		}
 	}
-	tmpFile.Close()
+	if substitutes {
+		lines = append(lines, scrollIndicatorStyle.Render("Runs a command substitution when expanded"))
+	}
+	return strings.Join(lines, "\n")
+}
 
-	c := exec.Command(editor, tmpFile.Name())
-	return tea.ExecProcess(c, func(err error) tea.Msg {
-		defer os.Remove(tmpFile.Name())
+// oneLiner joins the lines of a multi-line command into one, with "; " where
+// a line ends a command so they still run one after the other. It says why
+// when joining would change what the command does.
+func oneLiner(cmdStr string) (string, error) {
+	if strings.Contains(cmdStr, "<<") {
+		return "", fmt.Errorf("it uses a heredoc")
+	}
 
-		if err != nil {
-			return editMessageMsg{index: index, err: err}
+	var line strings.Builder
+	var quote byte
+	inCase := 0
+	prev := ""
+	continued := false
+	for _, part := range strings.Split(cmdStr, "\n") {
+		if quote != 0 {
+			return "", fmt.Errorf("a quoted string spans several lines")
 		}
-
-		data, err := os.ReadFile(tmpFile.Name())
-		if err != nil {
-			return editMessageMsg{index: index, err: err}
+		part = strings.TrimSpace(part)
+		if part == "" || strings.HasPrefix(part, "#") {
+			continue
+		}
+		for i := 0; i < len(part); i++ {
+			switch c := part[i]; {
+			case c == '\\' && quote != '\'':
+				i++
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '#' && (part[i-1] == ' ' || part[i-1] == '\t'):
+				return "", fmt.Errorf("a line ends in a comment")
+			}
 		}
 
-		return editMessageMsg{index: index, edited: string(data)}
-	})
+		switch {
+		case continued:
+			line.WriteString(" ")
+		case prev != "":
+			line.WriteString(oneLinerSeparator(prev, part, inCase > 0))
+		}
+		// Only an odd number of trailing backslashes leaves one unescaped to
+		// continue the line, a line ending in \\ ends in an escaped backslash
+		continued = (len(part)-len(strings.TrimRight(part, "\\")))%2 == 1
+		if continued {
+			part = strings.TrimSpace(part[:len(part)-1])
+		}
+		line.WriteString(part)
+		if part == "" {
+			continue
+		}
+		switch strings.Fields(part)[0] {
+		case "case":
+			inCase++
+		case "esac":
+			inCase--
+		}
+		prev = part
+	}
+	if quote != 0 {
+		return "", fmt.Errorf("a quote isn't closed")
+	}
+	return line.String(), nil
 }
 
-func (m model) handleCommandExecution() (tea.Model, tea.Cmd) {
-	var targetMsg string
-	if m.mode == ModeEditing {
-		if m.messages[m.cursorIndex].Role == "assistant" {
-			targetMsg = m.messages[m.cursorIndex].Content
-		}
-	} else {
-		// Find last assistant message
-		for i := len(m.messages) - 1; i >= 0; i-- {
-			if m.messages[i].Role == "assistant" {
-				targetMsg = m.messages[i].Content
-				break
-			}
+// oneLinerSeparator is what goes between line and next when they're joined:
+// just a space when line can't end a command, like after a pipe, "then" or a
+// case pattern, or next starts with its own ";", and "; " otherwise
+func oneLinerSeparator(line, next string, inCase bool) string {
+	if strings.HasPrefix(next, ";") {
+		return " "
+	}
+	for _, suffix := range []string{"|", "&&", "||", ";", "&", "{", "("} {
+		if strings.HasSuffix(line, suffix) {
+			return " "
 		}
 	}
+	if inCase && strings.HasSuffix(line, ")") {
+		return " "
+	}
+	fields := strings.Fields(line)
+	switch fields[len(fields)-1] {
+	case "then", "do", "else", "in":
+		return " "
+	}
+	return "; "
+}
 
-	if targetMsg == "" {
-		return m, nil
+// unsetVariable returns the first variable cmdStr uses that isn't set in env
+func unsetVariable(cmdStr string, env []string) string {
+	vars, _ := commandExpansions(cmdStr, env)
+	for _, v := range vars {
+		if !v.set {
+			return v.name
+		}
 	}
+	return ""
+}
 
-	// Use the same regex pattern as formatContent
-	re := regexp.MustCompile(`(?s)<command>(.*?)</command>`)
-	matches := re.FindAllStringSubmatch(targetMsg, -1)
+// limitedWriter collects command output up to limit bytes. Past that it
+// kills the command and throws the rest away.
+type limitedWriter struct {
+	buf       bytes.Buffer
+	limit     int
+	cmd       *exec.Cmd
+	truncated bool
+}
 
-	if len(matches) == 0 {
-		return m, nil
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.buf.Len()+len(p) > w.limit {
+		w.buf.Write(p[:w.limit-w.buf.Len()])
+		if !w.truncated {
+			w.truncated = true
+			procgroup.Kill(w.cmd)
+		}
+		return len(p), nil
 	}
+	return w.buf.Write(p)
+}
 
-	// Clean up commands before execution
-	for i := range matches {
-		matches[i][1] = strings.TrimSpace(matches[i][1])
+// commandEnv returns gpt-term's environment with command_env added, or nil to
+// leave it as it is
+func commandEnv(extra map[string]string) []string {
+	if len(extra) == 0 {
+		return nil
 	}
+	env := os.Environ()
+	for _, name := range sortedKeys(extra) {
+		env = append(env, name+"="+os.ExpandEnv(extra[name]))
+	}
+	return env
+}
 
-	// Always show command selection, even for single commands
-	m.mode = ModeCommandSelect
-	m.commands = matches
-	m.selectedCommand = 0
-
-	return m, nil
+// sortedKeys returns the keys of m in order, so variables are listed the same
+// way every time
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-// Add this function to handle command execution and output
-func executeCommand(cmdStr string) tea.Cmd {
+// Add this function to handle command execution and output. Output past
+// maxOutputMB kills the command. A nil env runs it with gpt-term's.
+func executeCommand(shell []string, cmdStr, dir string, env []string, maxOutputMB int) tea.Cmd {
 	return func() tea.Msg {
-		cmd := exec.Command("sh", "-c", cmdStr)
-		output, err := cmd.CombinedOutput()
+		cmd := exec.Command(shell[0], append(shell[1:len(shell):len(shell)], cmdStr)...)
+		cmd.Dir = dir
+		cmd.Env = env
+		output := &limitedWriter{limit: maxOutputMB << 20, cmd: cmd}
+		cmd.Stdout = output
+		cmd.Stderr = output
+		// Killing it kills the pipelines and background jobs it started too
+		procgroup.Set(cmd)
+		// Don't wait for children of the killed shell that still hold the pipe
+		cmd.WaitDelay = time.Second
+		err := cmd.Run()
+
 		var status string
-		if err != nil {
+		switch {
+		case output.truncated:
+			status = fmt.Sprintf("Output truncated at %d MB, command killed\n", maxOutputMB)
+			err = nil
+		case err != nil:
 			status = fmt.Sprintf("Command failed: %v\n", err)
-		} else {
+		default:
 			status = "Command executed successfully\n"
 		}
 		return commandOutputMsg{
-			output: fmt.Sprintf("Command ran: %s\nCommand result:\n%s%s", cmdStr, status, string(output)),
-			err:    err,
+			output:    fmt.Sprintf("Command ran: %s\nCommand result:\n%s%s", cmdStr, status, output.buf.String()),
+			err:       err,
+			command:   cmdStr,
+			raw:       output.buf.String(),
+			exitCode:  cmd.ProcessState.ExitCode(),
+			truncated: output.truncated,
 		}
 	}
 }
@@ -801,86 +3872,370 @@ func (m model) View() string {
 		return "\n  Initializing..."
 	}
 
+	// Nothing but the conversation and the input
+	if m.config.MinimalUI {
+		return m.withCommandOverlay(m.viewport.View() + "\n" + m.minimalStatusView())
+	}
+
 	// Build the final view
 	var finalView strings.Builder
-
-	// Add conversation title
-	if m.conversation != nil && m.conversation.Summary != "" {
-		finalView.WriteString(titleStyle.Render(m.conversation.Summary))
-		finalView.WriteString("\n")
-	}
+	finalView.WriteString(m.headerView())
 
 	// Add main content
-	finalView.WriteString("  ") // Two spaces for left margin alignment
-	if m.viewport.YOffset > 0 {
-		finalView.WriteString(scrollIndicatorStyle.Render(upArrow))
-	} else if len(m.messages) > 1 { // Only show beginning text if there are messages beyond system prompt
-		finalView.WriteString(scrollIndicatorStyle.Render(endText))
-	} else {
+	finalView.WriteString(m.viewport.View())
+
+	if m.config.Compact {
 		finalView.WriteString("\n")
+		finalView.WriteString(m.statusBarView())
+		return m.withCommandOverlay(finalView.String())
 	}
-	finalView.WriteString("\n")
-
-	// Add main content
-	finalView.WriteString(m.viewport.View())
 
 	// Add scroll down indicator
 	finalView.WriteString("\n")
 	finalView.WriteString("  ") // Two spaces for left margin alignment
 	if m.viewport.YOffset < m.viewport.TotalLineCount()-m.viewport.Height {
 		finalView.WriteString(scrollIndicatorStyle.Render(downArrow))
+		if m.isLoading && !m.following {
+			finalView.WriteString(scrollIndicatorStyle.Render(" new output below, End to follow"))
+		} else if m.newBelow {
+			finalView.WriteString(scrollIndicatorStyle.Render(" new message below, End to jump to it"))
+		}
+	} else if m.isLoading && m.following {
+		finalView.WriteString(followingStyle.Render("● following"))
 	} else {
 		finalView.WriteString(scrollIndicatorStyle.Render(endText))
 	}
+	if m.toast != "" {
+		style := toastStyle
+		if m.toastIsError {
+			style = toastErrorStyle
+		}
+		finalView.WriteString(" " + style.Render(m.toast))
+	}
 
 	finalView.WriteString("\n\n") // Added extra newline for margin
 	finalView.WriteString(m.statusBarView())
 
-	// If in command select mode, overlay the command selection
+	return m.withCommandOverlay(finalView.String())
+}
+
+// withCommandOverlay draws the command selection over view in command select
+// mode
+func (m model) withCommandOverlay(view string) string {
 	if m.mode == ModeCommandSelect {
-		var overlay strings.Builder
-		overlay.WriteString("Select a command to execute or copy:\n\n")
-
-		for i, match := range m.commands {
-			cmd := match[1]
-			line := fmt.Sprintf("%d: %s", i+1, cmd)
-			if i == m.selectedCommand {
-				overlay.WriteString(selectedStyle.Render(line))
-			} else {
-				overlay.WriteString(line)
+		overlayContent := m.commandOverlayView()
+		overlayStart := m.commandOverlayStart(overlayContent)
+
+		// Split the final view into lines
+		lines := strings.Split(view, "\n")
+
+		// Insert the overlay in the middle
+		var result strings.Builder
+		for i := 0; i < len(lines); i++ {
+			if i == overlayStart {
+				result.WriteString(overlayContent)
+				result.WriteString("\n")
+			}
+			if i < len(lines) {
+				result.WriteString(lines[i])
+				if i < len(lines)-1 {
+					result.WriteString("\n")
+				}
+			}
+		}
+
+		return result.String()
+	}
+
+	return view
+}
+
+// headerView renders everything above the viewport: the conversation title
+// and the scroll up indicator
+func (m model) headerView() string {
+	var s strings.Builder
+
+	// Add conversation title
+	if m.conversation != nil && m.conversation.Summary != "" {
+		title := titleStyle.Render(m.conversation.Summary)
+		infoText := conversationInfo(m.conversation, time.Now())
+		if m.switchedFrom != "" {
+			infoText += " · ⇄ from " + m.switchedFrom
+		}
+		info := scrollIndicatorStyle.Render(infoText)
+		if m.config.Compact {
+			// Only the title, on a single line
+			title = titleStyle.MarginBottom(0).Render(m.conversation.Summary)
+			s.WriteString(lipgloss.NewStyle().MaxWidth(m.width).Render(title + " " + info))
+			s.WriteString("\n")
+			return s.String()
+		}
+		s.WriteString(lipgloss.JoinHorizontal(lipgloss.Top, title, " ", info))
+		s.WriteString("\n")
+	}
+	if m.config.Compact {
+		return s.String()
+	}
+
+	s.WriteString("  ") // Two spaces for left margin alignment
+	if m.viewport.YOffset > 0 {
+		s.WriteString(scrollIndicatorStyle.Render(upArrow))
+	} else if len(m.messages) > 1 { // Only show beginning text if there are messages beyond system prompt
+		s.WriteString(scrollIndicatorStyle.Render(endText))
+	} else {
+		s.WriteString("\n")
+	}
+	s.WriteString("\n")
+
+	return s.String()
+}
+
+// conversationInfo summarizes the size of a conversation for the title bar,
+// e.g. "12 messages · started 3h ago · 4.2k tokens"
+func conversationInfo(conv *storage.Conversation, now time.Time) string {
+	count := 0
+	for _, msg := range conv.Messages {
+		if msg.Role != "system" && msg.Role != dividerRole {
+			count++
+		}
+	}
+
+	info := fmt.Sprintf("%d messages · started %s", count, timeAgo(conv.CreatedAt, now))
+	if conv.Persona != "" && conv.Persona != persona.Default {
+		info += " · " + conv.Persona
+	}
+	if conv.Settings != nil {
+		info += " · " + formatSettings(conv.Settings)
+	}
+	if tokens := conv.InputTokens + conv.OutputTokens; tokens > 0 {
+		info += " · " + formatTokens(tokens) + " tokens"
+	}
+	if conv.ContextFile != "" {
+		info += " · with " + filepath.Base(conv.ContextFile)
+	}
+	return info
+}
+
+// formatSettings writes a conversation's settings the way parseSettings reads
+// them, e.g. "model=claude-3-5-haiku-20241022 temperature=0.2"
+func formatSettings(settings *storage.Settings) string {
+	var parts []string
+	if settings.Model != "" {
+		parts = append(parts, "model="+settings.Model)
+	}
+	if settings.MaxTokens > 0 {
+		parts = append(parts, "max_tokens="+strconv.Itoa(settings.MaxTokens))
+	}
+	if settings.Temperature != nil {
+		parts = append(parts, "temperature="+strconv.FormatFloat(*settings.Temperature, 'g', -1, 64))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseSettings reads settings typed as key=value pairs. An empty value
+// leaves the setting to the config, nothing at all means no settings.
+func parseSettings(value string) (*storage.Settings, error) {
+	settings := &storage.Settings{}
+	for _, field := range strings.Fields(value) {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a setting, use key=value", field)
+		}
+		if val == "" {
+			continue
+		}
+		switch key {
+		case "model":
+			settings.Model = val
+		case "max_tokens":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("max_tokens must be a positive number, got %q", val)
 			}
-			overlay.WriteString("\n")
+			settings.MaxTokens = n
+		case "temperature":
+			t, err := strconv.ParseFloat(val, 64)
+			if err != nil || t < 0 || t > 1 {
+				return nil, fmt.Errorf("temperature must be between 0 and 1, got %q", val)
+			}
+			settings.Temperature = &t
+		default:
+			return nil, fmt.Errorf("unknown setting %q, use model, max_tokens or temperature", key)
+		}
+	}
+	if *settings == (storage.Settings{}) {
+		return nil, nil
+	}
+	return settings, nil
+}
+
+// timeAgo formats how long before now t was, e.g. "5m ago"
+func timeAgo(t, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+}
+
+// formatTokens abbreviates large token counts, e.g. 4200 becomes "4.2k"
+func formatTokens(tokens int) string {
+	if tokens < 1000 {
+		return strconv.Itoa(tokens)
+	}
+	return fmt.Sprintf("%.1fk", float64(tokens)/1000)
+}
+
+// commandOverlayView renders the command selection box drawn over the conversation
+func (m model) commandOverlayView() string {
+	var overlay strings.Builder
+	overlay.WriteString(m.commandOverlayTitle())
+
+	for i, cmd := range m.commands {
+		overlay.WriteString(m.commandLabel(fmt.Sprintf("%d: %s", i+1, cmd.text), cmd, i == m.selectedCommand))
+		overlay.WriteString("\n")
+	}
+
+	if m.showExplanation && len(m.commands) > 0 {
+		text := m.explanations[m.commands[m.selectedCommand].text]
+		if text == "" {
+			text = "Explaining..."
+		}
+		width := max(20, min(70, m.width-12))
+		overlay.WriteString("\n" + scrollIndicatorStyle.Width(width).Render(text) + "\n")
+	}
+
+	if m.config.ExpansionWarnings && len(m.commands) > 0 {
+		if expansions := expansionsView(m.commands[m.selectedCommand].text, commandEnv(m.config.CommandEnv)); expansions != "" {
+			overlay.WriteString("\n" + expansions + "\n")
 		}
+	}
+
+	if m.config.ShowEnvironment && len(m.commands) > 0 {
+		overlay.WriteString("\n" + scrollIndicatorStyle.Render(commandEnvironment(m.shell(), m.commands[m.selectedCommand].text, m.conversation.Dir, m.config.CommandEnv)) + "\n")
+	} else if len(m.config.CommandEnv) > 0 {
+		// Always say which variables command_env adds
+		overlay.WriteString("\n" + scrollIndicatorStyle.Render(envSummary(m.config.CommandEnv)) + "\n")
+	}
+
+	return overlayStyle.Render(overlay.String())
+}
+
+var elevatedRe = regexp.MustCompile(`(^|[\s;&|(])(sudo|doas|pkexec|su)(\s|$)`)
+
+// commandEnvironment describes where and how cmdStr would run, so running it
+// in the wrong directory, as root or with unexpected variables doesn't come as
+// a surprise
+func commandEnvironment(shell []string, cmdStr, dir string, env map[string]string) string {
+	program, err := exec.LookPath(shell[0])
+	if err != nil {
+		program = shell[0]
+	}
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			dir = "unknown"
+		}
+	}
+
+	privileges := "your user"
+	if u, err := user.Current(); err == nil {
+		privileges = u.Username
+	}
+	if os.Geteuid() == 0 {
+		privileges = "root"
+	}
+	if match := elevatedRe.FindStringSubmatch(cmdStr); match != nil {
+		privileges += ", elevated with " + match[2]
+	}
 
-		overlayContent := overlayStyle.Render(overlay.String())
+	s := fmt.Sprintf("Shell: %s\nDirectory: %s\nRuns as: %s", strings.Join(append([]string{program}, shell[1:]...), " "), dir, privileges)
+	if len(env) > 0 {
+		s += "\n" + envSummary(env)
+	}
+	return s
+}
 
-		// Calculate position to center the overlay
-		overlayLines := strings.Count(overlayContent, "\n") + 1
-		viewportMiddle := m.height / 2
-		overlayStart := viewportMiddle - overlayLines/2
+// envSummary lists the variables command_env adds, as they're written in the
+// config
+func envSummary(env map[string]string) string {
+	vars := make([]string, 0, len(env))
+	for _, name := range sortedKeys(env) {
+		vars = append(vars, name+"="+env[name])
+	}
+	return "Environment: " + strings.Join(vars, " ")
+}
 
-		// Split the final view into lines
-		lines := strings.Split(finalView.String(), "\n")
+// commandOverlayStart returns the screen row where the overlay is drawn so it
+// ends up centered
+func (m model) commandOverlayStart(overlayContent string) int {
+	overlayLines := strings.Count(overlayContent, "\n") + 1
+	viewportMiddle := m.height / 2
+	return viewportMiddle - overlayLines/2
+}
 
-		// Insert the overlay in the middle
-		var result strings.Builder
-		for i := 0; i < len(lines); i++ {
-			if i == overlayStart {
-				result.WriteString(overlayContent)
-				result.WriteString("\n")
-			}
-			if i < len(lines) {
-				result.WriteString(lines[i])
-				if i < len(lines)-1 {
-					result.WriteString("\n")
-				}
-			}
+// commandAtRow maps a screen row inside the command overlay to the index of
+// the command rendered there
+func (m model) commandAtRow(y int) (int, bool) {
+	row := m.commandOverlayStart(m.commandOverlayView()) +
+		overlayStyle.GetBorderTopSize() + overlayStyle.GetPaddingTop() +
+		strings.Count(m.commandOverlayTitle(), "\n")
+	for i, cmd := range m.commands {
+		// As tall as it's drawn, wrapped lines included
+		height := lipgloss.Height(m.commandLabel(fmt.Sprintf("%d: %s", i+1, cmd.text), cmd, i == m.selectedCommand))
+		if y >= row && y < row+height {
+			return i, true
 		}
+		row += height
+	}
+	return 0, false
+}
 
-		return result.String()
+// conversationAtRow maps a screen row in the history list to the index of the
+// conversation rendered there
+func (m model) conversationAtRow(y int) (int, bool) {
+	// Rows above the list: the header, the viewport margin and the history title
+	line := y - strings.Count(m.headerView(), "\n") - m.viewport.Style.GetMarginTop() + m.viewport.YOffset
+	row := line - strings.Count(historyTitle, "\n")
+	if row < 0 {
+		return 0, false
+	}
+	index := row / m.historyRowHeight()
+	if index < 0 || index >= len(m.conversations) {
+		return 0, false
+	}
+	return index, true
+}
+
+// stepSelection moves a list selection by delta, wrapping around the ends of
+// the list when the wrap_lists option is on and stopping at them otherwise
+func (m model) stepSelection(current, delta, count int) int {
+	if count == 0 {
+		return 0
 	}
+	if m.config.WrapLists {
+		return ((current+delta)%count + count) % count
+	}
+	return max(0, min(count-1, current+delta))
+}
 
-	return finalView.String()
+// isDoubleClick records a click on a list item and reports whether it
+// follows a click on the same item closely enough to count as a double click
+func (m *model) isDoubleClick(index int) bool {
+	now := time.Now()
+	double := index == m.lastClickIndex && now.Sub(m.lastClickTime) < doubleClickInterval
+	m.lastClickIndex = index
+	m.lastClickTime = now
+	if double {
+		// Don't let a third click chain into another double click
+		m.lastClickTime = time.Time{}
+	}
+	return double
 }
 
 // Helper function for debug info
@@ -891,99 +4246,646 @@ func min(a, b int) int {
 	return b
 }
 
+// keyHint is one entry of the key hint bar, e.g. "^R history"
+type keyHint struct {
+	key  string
+	desc string
+}
+
+// Hints shown in the status bar for each mode, most relevant first. The full
+// list of bindings is in the help screen.
+var modeHints = map[Mode][]keyHint{
+	ModeNormal: {
+		{"^X", "execute"}, {"^R", "history"}, {"^N", "new"}, {"^J", "edit"},
+		{"^Y", "copy commands"}, {"^P", "attach clipboard"}, {"^T", "rename"}, {"^H", "help"}, {"↑↓", "scroll"}, {"^C", "quit"},
+	},
+	ModeEditing: {
+		{"j/k", "move"}, {"enter", "edit"}, {"x", "execute"}, {"c", "copy"},
+		{"m", "raw/formatted"}, {"w", "save"}, {"f", "flag"}, {"t", "thinking"}, {"s", "system prompt"}, {"esc", "back"},
+	},
+	ModeHistory: {
+		{"enter", "open"}, {"↑↓", "move"}, {"/", "search"}, {"d", "duplicate"}, {"l", "read-only"}, {"t", "timestamps"}, {"^R", "refresh"}, {"esc", "back"},
+	},
+	ModeCommandSelect: {
+		{"enter", "run"}, {"1-9", "pick"}, {"l", "run live"}, {"c", "copy"}, {"o", "copy as one line"}, {"?", "explain"}, {"w", "wrap"}, {"esc", "cancel"},
+	},
+	ModeHelp: {
+		{"↑↓", "scroll"}, {"^D/^U", "half page"}, {"/", "search"}, {"n/N", "next/prev"}, {"12g", "line 12"}, {"esc", "close help"},
+	},
+	ModeOutputSelect: {
+		{"↑↓", "move"}, {"space", "select from here"}, {"enter", "attach"}, {"a", "attach all"}, {"esc", "cancel"},
+	},
+	ModeTemplateSelect: {
+		{"enter", "start chat"}, {"↑↓", "move"}, {"esc", "cancel"},
+	},
+	ModePrompt: {
+		{"enter", "confirm"}, {"esc", "cancel"},
+	},
+	ModeStats: {
+		{"↑↓", "scroll"}, {"^D/^U", "half page"}, {"/", "search"}, {"n/N", "next/prev"}, {"12g", "line 12"}, {"esc", "back"},
+	},
+	ModeDebug: {
+		{"c", "copy"}, {"↑↓", "scroll"}, {"^D/^U", "half page"}, {"/", "search"}, {"n/N", "next/prev"}, {"12g", "line 12"}, {"esc", "back"},
+	},
+	ModeOutput: {
+		{"c", "copy"}, {"↑↓", "scroll"}, {"^D/^U", "half page"}, {"/", "search"}, {"n/N", "next/prev"}, {"12g", "line 12"}, {"esc", "back"},
+	},
+}
+
+// renderHints lays out as many hints as fit in width, dropping the least
+// relevant ones rather than wrapping
+func renderHints(hints []keyHint, width int) string {
+	var s strings.Builder
+	for i, hint := range hints {
+		rendered := hintKeyStyle.Render(hint.key) + " " + hintDescStyle.Render(hint.desc)
+		if i > 0 {
+			rendered = "  " + rendered
+		}
+		if width > 0 && lipgloss.Width(s.String()+rendered) > width {
+			break
+		}
+		s.WriteString(rendered)
+	}
+	return s.String()
+}
+
 func (m model) statusBarView() string {
 	var status string
-	if m.isLoading {
-		status = m.spinner.View() + " Loading..."
+	if m.isLoading && m.retry != nil {
+		wait := max(0, time.Until(m.retryAt).Round(time.Second))
+		status = m.spinner.View() + fmt.Sprintf(" %s, retrying (attempt %d/%d) in %s… Esc gives up",
+			m.retry.Reason, m.retry.Attempt, m.retry.MaxAttempts, wait)
+	} else if m.isLoading {
+		status = m.spinner.View() + " Loading... Esc stops"
+	} else if m.notice != "" {
+		status = scrollIndicatorStyle.Render(m.notice)
+	} else if isPagerMode(m.mode) {
+		status = scrollIndicatorStyle.Render(m.pager.Status(&m.viewport))
+	} else if m.live != nil {
+		status = scrollIndicatorStyle.Render(fmt.Sprintf("%s is running, its output goes to the model every %ds. Esc stops it.",
+			truncateLine(m.live.Text, 40), m.config.LiveFeedSeconds))
+	} else if m.attachment != "" {
+		status = scrollIndicatorStyle.Render(m.attachmentName + " attached, sent with your next prompt. Press the key again to remove it.")
+	} else if m.codeBlock {
+		status = scrollIndicatorStyle.Render("Your next prompt is sent as a code block. Press Alt+C to send it as text.")
+	} else if m.canResume() {
+		status = scrollIndicatorStyle.Render(m.messages[len(m.messages)-1].Truncated + ". Press Ctrl+G to continue it.")
+	} else if m.canFallback() {
+		status = scrollIndicatorStyle.Render(m.fallbackReason + ". Press Ctrl+F to retry with " + m.fallbackClient.Model() + ".")
+	} else if warning := rateLimitWarning(m.client.RateLimit(), time.Now()); warning != "" {
+		status = scrollIndicatorStyle.Render(warning)
+	} else if context := m.contextStatus(); context != "" {
+		status = scrollIndicatorStyle.Render(context)
+	}
+	hints := renderHints(modeHints[m.mode], m.width)
+
+	if m.config.Compact {
+		return m.compactStatusView(status, hints)
 	}
+
 	switch m.mode {
 	case ModeNormal:
-		return fmt.Sprintf("%s\n%s\n↑/↓: Scroll | Ctrl+J/K: Edit | Ctrl+X/X: Execute | Ctrl+R: History | Ctrl+N: New chat | Ctrl+H: Show full help",
-			m.textInput.View(), status)
-	case ModeEditing:
-		return "Press ESC to exit, J/K to navigate messages, Enter to edit message, X to execute command, C to copy message"
-	case ModeHistory:
-		return "Press ESC to exit, Enter to select conversation, Up/Down/MWheel to scroll"
+		if m.config.Sandbox.Enabled {
+			status = sandboxStyle.Render("SANDBOX") + " " + status
+		}
+		if m.live != nil {
+			status = liveStyle.Render("● LIVE") + " " + status
+		}
+		return fmt.Sprintf("%s\n%s\n%s", m.inputView(), status, hints)
 	case ModeCommandSelect:
-		if len(m.commands) == 1 {
-			return "Press Enter to execute command, C to copy command, ESC to cancel"
+		if m.config.Sandbox.Enabled {
+			return sandboxStyle.Render("SANDBOX") + " Only allowlisted commands can run\n" + hints
 		}
-		return "Press ESC to exit, Enter/number to execute selected command, C to copy selected command"
-	case ModeHelp:
-		return "Press any key to exit help"
+		return hints
+	case ModePrompt:
+		return fmt.Sprintf("%s %s\n%s\n%s", m.promptLabel, m.promptInput.View(), status, hints)
+	case ModeHelp, ModeStats, ModeDebug, ModeOutput:
+		return status + "\n" + hints
 	default:
-		return ""
+		return hints
+	}
+}
+
+// minimalStatusView is the status bar of the minimal UI: the input, and under
+// it only toasts, the spinner and notices, without key hints
+func (m model) minimalStatusView() string {
+	var status string
+	switch {
+	case m.toast != "" && m.toastIsError:
+		status = toastErrorStyle.Render(m.toast)
+	case m.toast != "":
+		status = toastStyle.Render(m.toast)
+	case m.isLoading:
+		status = m.spinner.View()
+	case m.notice != "":
+		status = scrollIndicatorStyle.Render(m.notice)
+	}
+
+	switch m.mode {
+	case ModeNormal:
+		return m.inputView() + "\n" + status
+	case ModePrompt:
+		return m.promptLabel + " " + m.promptInput.View() + "\n" + status
+	default:
+		return "\n" + status
+	}
+}
+
+// inputView renders the prompt input, greyed out in a read-only conversation
+func (m model) inputView() string {
+	if m.conversation.ReadOnly {
+		return scrollIndicatorStyle.Render("> Read-only conversation")
+	}
+	return m.textInput.View()
+}
+
+// compactStatusView puts everything below the viewport on one line: the input
+// followed by the status, or a toast while one is shown. Modes without an
+// input keep their key hints.
+func (m model) compactStatusView(status, hints string) string {
+	if m.toast != "" {
+		style := toastStyle
+		if m.toastIsError {
+			style = toastErrorStyle
+		}
+		status = style.Render(m.toast)
+	}
+
+	var line string
+	switch m.mode {
+	case ModeNormal:
+		if m.config.Sandbox.Enabled {
+			status = sandboxStyle.Render("SANDBOX") + " " + status
+		}
+		if m.live != nil {
+			status = liveStyle.Render("● LIVE") + " " + status
+		}
+		line = m.inputView() + " " + status
+	case ModePrompt:
+		line = m.promptLabel + " " + m.promptInput.View()
+	case ModeHelp, ModeStats, ModeDebug, ModeOutput:
+		line = status
+	default:
+		if m.toast != "" {
+			line = status
+		} else {
+			line = hints
+		}
+	}
+	return lipgloss.NewStyle().MaxWidth(m.width).Render(line)
+}
+
+// rateLimitWarning describes the rate limit once less than a tenth of the
+// requests or tokens allowed are left, so heavy users can slow down before
+// they start getting 429s
+func rateLimitWarning(rl claude.RateLimit, now time.Time) string {
+	resetsIn := func(reset time.Time) string {
+		return reset.Sub(now).Round(time.Second).String()
+	}
+
+	switch {
+	case rl.RequestsLimit > 0 && rl.RequestsReset.After(now) && rl.RequestsRemaining*10 <= rl.RequestsLimit:
+		return fmt.Sprintf("rate limit: %d req left, resets in %s", rl.RequestsRemaining, resetsIn(rl.RequestsReset))
+	case rl.TokensLimit > 0 && rl.TokensReset.After(now) && rl.TokensRemaining*10 <= rl.TokensLimit:
+		return fmt.Sprintf("rate limit: %d tokens left, resets in %s", rl.TokensRemaining, resetsIn(rl.TokensReset))
 	}
+	return ""
 }
 
-func formatContent(content string) string {
+// formatContent styles code blocks, tables and commands for display. Commands
+// are numbered starting at firstCommand so they can be referred to in prompts.
+// Tables are fit into width. Code block lines are numbered if lineNumbers is set.
+func formatContent(content string, firstCommand, width int, lineNumbers bool) string {
 	// First handle code blocks - make regex more permissive to catch all variants
 	re := regexp.MustCompile("(?s)```.*?\n(.*?)```")
 	content = re.ReplaceAllStringFunc(content, func(match string) string {
 		// Extract the code content without the backticks and language identifier
 		code := re.FindStringSubmatch(match)[1]
+		if lineNumbers {
+			code = numberLines(code)
+		}
 		return "\n" + codeBlockStyle.Render(code) + "\n"
 	})
 
+	// Code blocks are styled by now, so their lines won't look like tables
+	content = renderTables(content, width)
+
 	// Then handle commands - make sure to handle newlines properly
-	cmdRe := regexp.MustCompile(`(?s)<command>(.*?)</command>`)
-	content = cmdRe.ReplaceAllStringFunc(content, func(match string) string {
-		cmd := cmdRe.FindStringSubmatch(match)[1]
-		// Trim any whitespace/newlines around the command
-		cmd = strings.TrimSpace(cmd)
-		return commandStyle.Render(cmd)
+	number := firstCommand
+	content = replaceCommandTags(content, func(tag commandTag) string {
+		label := commandNumberStyle.Render(strconv.Itoa(number))
+		number++
+		return label + commandStyle.Render(tag.text)
 	})
 
 	return content
 }
 
+// numberLines puts the line number in front of each line of code. They're
+// only drawn, copying a message still copies the code without them.
+func numberLines(code string) string {
+	lines := strings.Split(strings.TrimSuffix(code, "\n"), "\n")
+	digits := len(strconv.Itoa(len(lines)))
+	for i, line := range lines {
+		lines[i] = lineNumberStyle.Render(fmt.Sprintf("%*d │", digits, i+1)) + " " + line
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// renderTables draws markdown tables in content as aligned tables no wider
+// than width, cutting off the longest cells if they don't fit
+func renderTables(content string, width int) string {
+	separatorRe := regexp.MustCompile(`^\s*\|?(\s*:?-{3,}:?\s*\|)+\s*(:?-{3,}:?\s*)?\|?\s*$`)
+	isRow := func(line string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "|")
+	}
+
+	lines := strings.Split(content, "\n")
+	var out []string
+	for i := 0; i < len(lines); i++ {
+		if !isRow(lines[i]) || i+1 >= len(lines) || !separatorRe.MatchString(lines[i+1]) {
+			out = append(out, lines[i])
+			continue
+		}
+
+		headers := tableCells(lines[i])
+		var rows [][]string
+		j := i + 2
+		for ; j < len(lines) && isRow(lines[j]); j++ {
+			rows = append(rows, tableCells(lines[j]))
+		}
+
+		t := table.New().
+			Border(lipgloss.RoundedBorder()).
+			BorderStyle(scrollIndicatorStyle).
+			Headers(headers...).
+			Rows(rows...).
+			StyleFunc(func(row, col int) lipgloss.Style {
+				if row == table.HeaderRow {
+					return tableHeaderStyle
+				}
+				return tableCellStyle
+			})
+		rendered := t.Render()
+		if width > 0 && lipgloss.Width(rendered) > width {
+			rendered = t.Width(width).Render()
+		}
+		out = append(out, rendered)
+		i = j - 1
+	}
+	return strings.Join(out, "\n")
+}
+
+// tableCells splits a markdown table row into its trimmed cells
+func tableCells(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	line = strings.TrimSuffix(line, "|")
+	cells := strings.Split(line, "|")
+	for i, cell := range cells {
+		cells[i] = strings.TrimSpace(cell)
+	}
+	return cells
+}
+
+// taggedCommands returns the <command> tagged commands in content
+func taggedCommands(content string) []string {
+	var commands []string
+	for _, tag := range commandTags(content) {
+		commands = append(commands, tag.text)
+	}
+	return commands
+}
+
+// commandTag is a <command> tagged command in a message
+type commandTag struct {
+	start, end int    // Where it is in the message, tags included
+	text       string // The command, trimmed and unescaped
+}
+
+// commandTags finds the <command> tagged commands in content. A </command> in
+// quotes, e.g. in grep '</command>' notes.md, doesn't end the command as long
+// as the real closing tag follows before the next command starts. A model
+// following the system prompt escapes it as &lt;/command&gt; instead, which
+// is turned back into the tag.
+func commandTags(content string) []commandTag {
+	const open, close = "<command>", "</command>"
+	var tags []commandTag
+	for pos := 0; ; {
+		i := strings.Index(content[pos:], open)
+		if i < 0 {
+			break
+		}
+		start := pos + i
+		body := start + len(open)
+		first := strings.Index(content[body:], close)
+		if first < 0 {
+			break
+		}
+		end := body + first
+		// Quotes left open there make the first closing tag part of the
+		// command, unless that would swallow prose with an apostrophe and
+		// the next command
+		if unquoted := unquotedIndex(content[body:], close); unquoted > first && !strings.Contains(content[end:body+unquoted], open) {
+			end = body + unquoted
+		}
+
+		text := strings.TrimSpace(content[body:end])
+		text = strings.NewReplacer("&lt;command&gt;", open, "&lt;/command&gt;", close).Replace(text)
+		tags = append(tags, commandTag{start: start, end: end + len(close), text: text})
+		pos = end + len(close)
+	}
+	return tags
+}
+
+// unquotedIndex returns where sub first appears in s outside of shell quotes,
+// or -1
+func unquotedIndex(s, sub string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == 0 && strings.HasPrefix(s[i:], sub):
+			return i
+		case c == '\\' && quote != '\'':
+			i++ // Skip what's escaped
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
+		}
+	}
+	return -1
+}
+
+// replaceCommandTags replaces each <command> tagged command in content with
+// what replace returns for it
+func replaceCommandTags(content string, replace func(commandTag) string) string {
+	var s strings.Builder
+	last := 0
+	for _, tag := range commandTags(content) {
+		s.WriteString(content[last:tag.start])
+		s.WriteString(replace(tag))
+		last = tag.end
+	}
+	s.WriteString(content[last:])
+	return s.String()
+}
+
+// commandRegistry numbers every command suggested in a conversation, in the
+// order they appear. Command n is at index n-1.
+func commandRegistry(messages []storage.Message) []string {
+	var commands []string
+	for _, msg := range messages {
+		if msg.Role == "assistant" {
+			commands = append(commands, taggedCommands(msg.Content)...)
+		}
+	}
+	return commands
+}
+
+// expandCommandRefs replaces references like "command 3" in a prompt with
+// the text of that command so the model knows exactly which one is meant
+func expandCommandRefs(prompt string, registry []string) string {
+	refRe := regexp.MustCompile(`(?i)\b(?:command|cmd) #?(\d+)\b`)
+	return refRe.ReplaceAllStringFunc(prompt, func(match string) string {
+		n, err := strconv.Atoi(refRe.FindStringSubmatch(match)[1])
+		if err != nil || n < 1 || n > len(registry) {
+			return match
+		}
+		return fmt.Sprintf("%s (`%s`)", match, registry[n-1])
+	})
+}
+
 func (m model) normalView() string {
+	view, _ := m.numberedView()
+	return view
+}
+
+// numberedView renders the normal view and returns the line each user and
+// assistant message starts on, in order, -1 for ones hidden by the flag
+// filter. While the goto prompt is open the messages are shown numbered.
+func (m model) numberedView() (string, []int) {
 	var s strings.Builder
+	// Lines are counted as they're written, counting the whole view for
+	// every message would get slow in long chats
+	var lines int
+	write := func(text string) {
+		s.WriteString(text)
+		lines += strings.Count(text, "\n")
+	}
+	var starts []int
+	commandNum := 1
+	numbered := m.mode == ModePrompt && m.promptAction == promptGoto
+
+	for i, msg := range m.messages {
+		if msg.Role == "user" || msg.Role == "assistant" {
+			if m.flaggedOnly && !msg.Flagged {
+				starts = append(starts, -1)
+			} else {
+				starts = append(starts, lines)
+			}
+		}
+		number := ""
+		if numbered && msg.Role != "system" && msg.Role != dividerRole {
+			number = scrollIndicatorStyle.Render(fmt.Sprintf("#%d", len(starts))) + " "
+		}
 
-	for _, msg := range m.messages {
 		if msg.Role == "system" {
 			// Only show beginning text with timestamp for existing conversations
 			// (ones that have more than just the system message)
-			if len(m.messages) > 1 {
+			if len(m.messages) > 1 && !m.config.MinimalUI {
 				beginningText := fmt.Sprintf("- Beginning of conversation [%s] -",
 					m.conversation.CreatedAt.Format("Mon 02 Jan 2006 15:04"))
-				s.WriteString(scrollIndicatorStyle.Render(beginningText) + "\n\n")
+				write(scrollIndicatorStyle.Render(beginningText) + "\n\n")
+			}
+			if m.showSystem {
+				// The prompt is one long paragraph, so wrap it to the viewport
+				wrapped := scrollIndicatorStyle.Width(max(1, m.viewport.Width-4)).Render("system: " + msg.Content)
+				write(wrapped + "\n\n")
 			}
 			continue
 		}
+		if m.flaggedOnly && !msg.Flagged {
+			// Keep the numbers of the commands that are shown
+			commandNum += len(taggedCommands(msg.Content))
+			continue
+		}
 		switch msg.Role {
+		case dividerRole:
+			write(m.dividerView(msg) + "\n\n")
 		case "assistant":
-			content := formatContent(msg.Content)
-			s.WriteString(assistantLabelStyle.Render("assistant") + " " + botStyle.Render(content) + "\n\n")
+			content := m.renderAssistant(i, msg.Content, commandNum)
+			commandNum += len(taggedCommands(msg.Content))
+			write(m.thinkingView(i, msg))
+			write(number + flagMarker(msg) + m.assistantLabel(msg, assistantLabelStyle) + " " + botStyle.Render(content) + "\n\n")
 		default:
-			s.WriteString(userLabelStyle.Render("user") + " " + messageStyle.Render(msg.Content) + "\n\n")
+			write(number + flagMarker(msg) + userLabelStyle.Render("user") + " " + messageStyle.Render(msg.Content) + "\n\n")
 		}
 	}
 
-	return s.String()
+	if m.staged {
+		write(userLabelStyle.Render("user") + " " + thinkingStyle.Render(m.pendingPrompt()) + "\n")
+		write(instructionBarStyle.Render("Not sent yet. Press Enter to send it, or keep typing to change it") + "\n\n")
+	}
+
+	if m.flaggedOnly {
+		write(scrollIndicatorStyle.Render("Only flagged messages are shown. Flag one with F in edit mode, Alt+F shows all."))
+	}
+
+	return s.String(), starts
+}
+
+// gotoMessage scrolls so message number n, counting user and assistant
+// messages from 1, is at the top of the view
+func (m *model) gotoMessage(value string) {
+	_, starts := m.numberedView()
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > len(starts) {
+		m.notice = fmt.Sprintf("Pick a message from 1 to %d", len(starts))
+		return
+	}
+	if starts[n-1] < 0 {
+		m.notice = fmt.Sprintf("Message %d isn't flagged, Alt+F shows all messages", n)
+		return
+	}
+	m.viewport.SetYOffset(starts[n-1])
+	m.following = m.viewport.AtBottom()
+}
+
+// dividerView draws a divider across the viewport, with its label if it has one
+func (m model) dividerView(msg storage.Message) string {
+	line := "──"
+	if msg.Content != "" {
+		line += " " + msg.Content + " "
+	}
+	return dividerStyle.Render(line + strings.Repeat("─", max(2, m.viewport.Width-lipgloss.Width(line))))
+}
+
+// pendingPrompt is what sending the input would send: with command references
+// expanded, as a code block if asked for and after the attachment
+func (m model) pendingPrompt() string {
+	content := expandCommandRefs(m.textInput.Value(), commandRegistry(m.messages))
+	if m.codeBlock {
+		content = fenceCode(content)
+	}
+	if m.attachment != "" {
+		content = m.attachment + "\n\n" + content
+	}
+	return content
+}
+
+// flagMarker is drawn in front of messages flagged as important
+func flagMarker(msg storage.Message) string {
+	if !msg.Flagged {
+		return ""
+	}
+	return flaggedStyle.Render("★") + " "
+}
+
+// assistantLabel renders the label in front of a response in style, followed
+// by what it cost when message_tokens is on and the API reported it
+func (m model) assistantLabel(msg storage.Message, style lipgloss.Style) string {
+	label := style.Render("assistant")
+	if m.config.MessageTokens && msg.InputTokens+msg.OutputTokens > 0 {
+		label += " " + scrollIndicatorStyle.Render(fmt.Sprintf("%s in · %s out", formatTokens(msg.InputTokens), formatTokens(msg.OutputTokens)))
+	}
+	return label
+}
+
+// renderAssistant formats the assistant message at index, unless it was
+// switched to raw text with M in edit mode
+func (m model) renderAssistant(index int, content string, firstCommand int) string {
+	if !m.plainMessages[messageKey{m.conversation.ID, index}] {
+		content = markPaths(content)
+		// Leave room for the label in front of the message
+		content = formatContent(content, firstCommand, m.viewport.Width-lipgloss.Width(m.assistantLabel(m.messages[index], assistantLabelStyle))-1, m.config.LineNumbers)
+	}
+
+	// Cut long responses down to their first lines until expanded
+	if m.collapsible(index) && !m.expanded[messageKey{m.conversation.ID, index}] {
+		if lines := strings.Split(content, "\n"); len(lines) > collapsedLines {
+			content = strings.Join(lines[:collapsedLines], "\n") + "\n" +
+				thinkingStyle.Render(fmt.Sprintf("▶ show %d more lines (E in edit mode)", len(lines)-collapsedLines))
+		}
+	}
+	return content
+}
+
+// collapsible reports whether the message at index is a response long enough
+// to be collapsed. The one still streaming in isn't, so it can be followed.
+func (m model) collapsible(index int) bool {
+	msg := m.messages[index]
+	if m.config.CollapseLines <= 0 || msg.Role != "assistant" {
+		return false
+	}
+	if m.isLoading && m.streamConv == m.conversation && index == m.streamIndex {
+		return false
+	}
+	return strings.Count(msg.Content, "\n")+1 > max(m.config.CollapseLines, collapsedLines)
+}
+
+// thinkingView renders the model's reasoning for the message at index above
+// its answer, collapsed to a single line unless expanded with T in edit mode
+func (m model) thinkingView(index int, msg storage.Message) string {
+	if msg.Thinking == "" {
+		return ""
+	}
+	if !m.showThinking[messageKey{m.conversation.ID, index}] {
+		lines := strings.Count(strings.TrimSpace(msg.Thinking), "\n") + 1
+		return thinkingStyle.Render(fmt.Sprintf("▸ thinking (%d lines)", lines)) + "\n"
+	}
+	wrapped := thinkingStyle.Width(max(1, m.viewport.Width-4)).Render(strings.TrimSpace(msg.Thinking))
+	return thinkingStyle.Render("▾ thinking") + "\n" + wrapped + "\n\n"
 }
 
 func (m model) editingView() string {
 	var s strings.Builder
 	s.WriteString("Editing Mode\n\n")
+	commandNum := 1
 
 	for i, msg := range m.messages {
 		var content string
 		if msg.Role == "assistant" {
-			content = formatContent(msg.Content)
+			content = m.renderAssistant(i, msg.Content, commandNum)
+			commandNum += len(taggedCommands(msg.Content))
+		}
+
+		if msg.Role == "assistant" {
+			s.WriteString(m.thinkingView(i, msg))
+		}
+
+		// While an edit waits for confirmation, show the change and strike
+		// out the messages it would discard
+		if edit := m.pendingEdit; edit != nil && m.mode == ModePrompt && m.promptAction == promptConfirmEdit && i >= edit.index {
+			label := userLabelStyle.Render(msg.Role)
+			if msg.Role == "assistant" {
+				label = assistantLabelStyle.Render(msg.Role)
+			}
+			if i == edit.index {
+				s.WriteString(selectedLabelStyle.Render(msg.Role) + " " + diffRemovedStyle.Render("- "+msg.Content) + "\n")
+				s.WriteString(strings.Repeat(" ", lipgloss.Width(selectedLabelStyle.Render(msg.Role))+1) + diffAddedStyle.Render("+ "+strings.TrimSpace(edit.edited)))
+			} else {
+				s.WriteString(label + " " + discardedStyle.Render(msg.Content))
+			}
+			s.WriteString("\n\n")
+			continue
 		}
 
+		s.WriteString(flagMarker(msg))
 		if i == m.cursorIndex {
 			switch msg.Role {
 			case "system":
 				s.WriteString(systemStyle.Render(fmt.Sprintf("%s: %s", msg.Role, msg.Content)))
+			case dividerRole:
+				s.WriteString(selectedMessageStyle.Render(m.dividerView(msg)))
+				s.WriteString("\n" + instructionBarStyle.Render("Press D to remove the divider"))
 			case "user":
 				s.WriteString(selectedLabelStyle.Render("user") + " " + selectedMessageStyle.Render(msg.Content))
 				s.WriteString("\n" + instructionBarStyle.Render("Press Enter to edit, C to copy message"))
 			case "assistant":
-				s.WriteString(selectedLabelStyle.Render("assistant") + " " + selectedMessageStyle.Render(content))
+				s.WriteString(m.assistantLabel(msg, selectedLabelStyle) + " " + selectedMessageStyle.Render(content))
 				// Show appropriate instructions based on message content
-				if strings.Contains(msg.Content, "<command>") {
+				if len(extractCommands(msg.Content, m.config.InlineCommands)) > 0 {
 					s.WriteString("\n" + instructionBarStyle.Render("Press X to execute commands, C to copy message"))
 				} else {
 					s.WriteString("\n" + instructionBarStyle.Render("Press C to copy message"))
@@ -993,10 +4895,12 @@ func (m model) editingView() string {
 			switch msg.Role {
 			case "system":
 				s.WriteString(systemStyle.Render(fmt.Sprintf("%s: %s", msg.Role, msg.Content)))
+			case dividerRole:
+				s.WriteString(m.dividerView(msg))
 			case "user":
 				s.WriteString(userLabelStyle.Render("user") + " " + messageStyle.Render(msg.Content))
 			case "assistant":
-				s.WriteString(assistantLabelStyle.Render("assistant") + " " + botStyle.Render(content))
+				s.WriteString(m.assistantLabel(msg, assistantLabelStyle) + " " + botStyle.Render(content))
 			}
 		}
 		s.WriteString("\n\n")
@@ -1005,23 +4909,41 @@ func (m model) editingView() string {
 	return s.String()
 }
 
-func (m model) historyView() string {
-	s := "Conversation History (Press ESC to exit)\n\n"
-
-	// Sort conversations by date in descending order
+// sortedConversations returns a copy of the loaded conversations, newest first,
+// in the order the history list shows them
+func (m model) sortedConversations() []storage.Conversation {
 	sortedConvs := make([]storage.Conversation, len(m.conversations))
 	copy(sortedConvs, m.conversations)
 	sort.Slice(sortedConvs, func(i, j int) bool {
 		return sortedConvs[i].CreatedAt.After(sortedConvs[j].CreatedAt)
 	})
+	return sortedConvs
+}
 
-	for i, conv := range sortedConvs {
-		line := fmt.Sprintf("[%s] %s", conv.CreatedAt.Format("2006-01-02 15:04:05"), conv.Summary)
+func (m model) historyView() string {
+	s := historyTitle
+	if m.searchQuery != "" {
+		s = fmt.Sprintf("%d conversations matching %q (Press ESC to clear)\n\n", len(m.conversations), m.searchQuery)
+	}
+
+	now := time.Now()
+	for i, conv := range m.sortedConversations() {
+		line := fmt.Sprintf("[%s] %s", m.historyTimestamp(conv.CreatedAt, now), conv.Summary)
+		if conv.ReadOnly {
+			line += " [read-only]"
+		}
+		if conv.Notes != "" {
+			note, _, _ := strings.Cut(conv.Notes, "\n")
+			line += " " + scrollIndicatorStyle.Render("✎ "+truncateLine(note, 40))
+		}
 		if i == m.selectedConv {
 			s += selectedStyle.Render(line) + "\n"
 		} else {
 			s += line + "\n"
 		}
+		if result, ok := m.searchResults[conv.ID]; ok {
+			s += "    " + highlightMatch(result) + "\n"
+		}
 	}
 
 	// Add extra newline at the end to ensure last entry is fully visible
@@ -1029,32 +4951,180 @@ func (m model) historyView() string {
 	return s
 }
 
+// historyTimestamp formats when a conversation started the way
+// history_timestamps asks for
+func (m model) historyTimestamp(t, now time.Time) string {
+	switch m.config.HistoryTimestamps {
+	case "relative":
+		return timeAgo(t, now)
+	case "date":
+		return t.Format("2006-01-02")
+	default:
+		return t.Format("2006-01-02 15:04:05")
+	}
+}
+
+// highlightMatch renders a search snippet with the matched text highlighted
+func highlightMatch(result storage.SearchResult) string {
+	snippet := result.Snippet
+	return scrollIndicatorStyle.Render(snippet[:result.MatchStart]) +
+		searchMatchStyle.Render(snippet[result.MatchStart:result.MatchEnd]) +
+		scrollIndicatorStyle.Render(snippet[result.MatchEnd:])
+}
+
+// historyRowHeight is how many lines each conversation takes in the history
+// list, two while searching since the snippet is shown under it
+func (m model) historyRowHeight() int {
+	if m.searchQuery != "" {
+		return 2
+	}
+	return 1
+}
+
 func (m model) commandSelectView() string {
 	var s strings.Builder
 
 	if len(m.commands) == 1 {
 		s.WriteString("Confirm command execution:\n\n")
-		cmd := m.commands[0][1]
-		if m.selectedCommand == 0 {
-			s.WriteString(selectedStyle.Render(cmd))
+		cmd := m.commands[0]
+		s.WriteString(m.commandLabel(cmd.text, cmd, m.selectedCommand == 0))
+		s.WriteString("\n\nPress Enter to execute, ESC to cancel")
+	} else {
+		s.WriteString("Select a command to execute:\n\n")
+		for i, cmd := range m.commands {
+			s.WriteString(m.commandLabel(fmt.Sprintf("%d: %s", i+1, cmd.text), cmd, i == m.selectedCommand))
+			s.WriteString("\n")
+		}
+	}
+
+	return s.String()
+}
+
+func (m model) templateSelectView() string {
+	var s strings.Builder
+	s.WriteString("Start a new chat from:\n\n")
+
+	var names []string
+	for _, p := range persona.Builtin {
+		name := p.Description
+		if p.Name == m.config.Persona || (m.config.Persona == "" && p.Name == persona.Default) {
+			name += " (default)"
+		}
+		names = append(names, name)
+	}
+	for _, tmpl := range m.config.Templates {
+		names = append(names, tmpl.Name)
+	}
+	for i, name := range names {
+		if i == m.selectedTemplate {
+			s.WriteString(selectedStyle.Render(name) + "\n")
 		} else {
-			s.WriteString(cmd)
+			s.WriteString(name + "\n")
+		}
+	}
+	return s.String()
+}
+
+func (m model) outputSelectView() string {
+	var s strings.Builder
+	s.WriteString(outputSelectTitle)
+
+	start, end := m.outputSelection()
+	for i, line := range m.outputLines {
+		prefix := "  "
+		if i == m.outputCursor {
+			prefix = "> "
+		}
+		if i >= start && i <= end {
+			line = selectedStyle.Render(line)
+		}
+		s.WriteString(prefix + line + "\n")
+	}
+	return s.String()
+}
+
+// stats is an overview of every stored conversation
+type stats struct {
+	conversations int
+	userMessages  int
+	replies       int
+	commands      int // Commands run from responses
+	inputTokens   int
+	outputTokens  int
+	days          map[string]int // Messages sent per day, keyed by date
+}
+
+func computeStats(conversations []storage.Conversation) stats {
+	s := stats{conversations: len(conversations), days: make(map[string]int)}
+	for _, conv := range conversations {
+		s.inputTokens += conv.InputTokens
+		s.outputTokens += conv.OutputTokens
+		for _, msg := range conv.Messages {
+			switch {
+			case msg.Role == "user":
+				s.userMessages++
+				s.days[msg.Timestamp.Format("2006-01-02")]++
+			case strings.HasPrefix(msg.Content, commandOutputPrefix):
+				s.commands++
+			case msg.Role == "assistant":
+				s.replies++
+			}
+		}
+	}
+	return s
+}
+
+// debugView shows the API request captured with Alt+Q
+func (m model) debugView() string {
+	title := "Last request sent to the API"
+	if !m.debugSent {
+		title = "Nothing sent yet, this is the request this conversation would be sent as"
+	}
+	// Long messages are wrapped on screen, C still copies them as they are
+	return title + " (key redacted)\n\n" + lipgloss.NewStyle().Width(max(1, m.viewport.Width)).Render(m.debugRequest)
+}
+
+// outputView shows the last command's whole output, opened with Alt+V
+func (m model) outputView() string {
+	output := m.lastOutput
+	if m.config.StripANSI {
+		output = stripANSI(output)
+	}
+	// Long lines are wrapped on screen, C still copies them as they are
+	return "$ " + m.lastCommand + "\n\n" + lipgloss.NewStyle().Width(max(1, m.viewport.Width)).Render(strings.TrimRight(output, "\n"))
+}
+
+func (m model) statsView() string {
+	var s strings.Builder
+	s.WriteString("Stats across all conversations\n\n")
+
+	s.WriteString(fmt.Sprintf("Conversations      %d\n", m.stats.conversations))
+	s.WriteString(fmt.Sprintf("Messages sent      %d\n", m.stats.userMessages))
+	s.WriteString(fmt.Sprintf("Responses          %d\n", m.stats.replies))
+	s.WriteString(fmt.Sprintf("Commands run       %d\n", m.stats.commands))
+	s.WriteString(fmt.Sprintf("Tokens             %s (%s in, %s out)\n",
+		formatTokens(m.stats.inputTokens+m.stats.outputTokens), formatTokens(m.stats.inputTokens), formatTokens(m.stats.outputTokens)))
+
+	// The busiest days, as bars relative to the busiest one
+	days := make([]string, 0, len(m.stats.days))
+	for day := range m.stats.days {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool {
+		if m.stats.days[days[i]] != m.stats.days[days[j]] {
+			return m.stats.days[days[i]] > m.stats.days[days[j]]
 		}
-		s.WriteString("\n\nPress Enter to execute, ESC to cancel")
-	} else {
-		s.WriteString("Select a command to execute:\n\n")
-		for i, match := range m.commands {
-			cmd := match[1]
-			line := fmt.Sprintf("%d: %s", i+1, cmd)
-			if i == m.selectedCommand {
-				s.WriteString(selectedStyle.Render(line))
-			} else {
-				s.WriteString(line)
-			}
-			s.WriteString("\n")
+		return days[i] > days[j]
+	})
+	if len(days) > 0 {
+		s.WriteString("\nMost active days\n\n")
+		busiest := m.stats.days[days[0]]
+		for _, day := range days[:min(len(days), 7)] {
+			count := m.stats.days[day]
+			bar := strings.Repeat("█", max(1, count*30/busiest))
+			s.WriteString(fmt.Sprintf("%s  %s %d\n", day, followingStyle.Render(bar), count))
 		}
 	}
-
 	return s.String()
 }
 
@@ -1125,7 +5195,7 @@ func (m *model) ensureConversationVisible(index int) {
 
 	// Find target conversation position
 	lines := strings.Split(content, "\n")
-	targetLine := index + 2 // Add 2 to account for header lines
+	targetLine := index*m.historyRowHeight() + 2 // Add 2 to account for header lines
 
 	// Calculate viewport constraints
 	totalLines := len(lines)
@@ -1156,10 +5226,23 @@ func (m *model) updateViewport() {
 	// Update viewport dimensions
 	m.viewport.Width = m.width - 4
 	m.viewport.Height = m.height - 7
+	if m.config.Compact {
+		// Only the title and the status line are left around it
+		m.viewport.Height = m.height - 1 - strings.Count(m.headerView(), "\n")
+	}
+	if m.config.MinimalUI {
+		// Only the input and a line for what's going on
+		m.viewport.Height = m.height - 2
+	}
 
 	// Generate content based on current mode
 	var content string
-	switch m.mode {
+	mode := m.mode
+	if mode == ModePrompt {
+		// Keep showing what the prompt was opened from
+		mode = m.promptReturn
+	}
+	switch mode {
 	case ModeNormal:
 		content = m.normalView()
 	case ModeEditing:
@@ -1168,20 +5251,36 @@ func (m *model) updateViewport() {
 		content = m.historyView()
 	case ModeCommandSelect:
 		content = m.commandSelectView()
+	case ModeTemplateSelect:
+		content = m.templateSelectView()
+	case ModeOutputSelect:
+		content = m.outputSelectView()
 	case ModeHelp:
 		content = helpMessage
+	case ModeStats:
+		content = m.statsView()
+	case ModeDebug:
+		content = m.debugView()
+	case ModeOutput:
+		content = m.outputView()
 	default:
 		content = "Unknown mode"
 	}
 
-	// Set content
-	m.viewport.SetContent(content)
-
-	// For help mode, always scroll to top
-	if m.mode == ModeHelp {
-		m.viewport.GotoTop()
+	// Long texts start from the top, then keep their place and search
+	if isPagerMode(mode) {
+		if mode != m.pagerMode {
+			m.pager.SetContent(&m.viewport, content)
+			m.pagerMode = mode
+		} else {
+			m.pager.Refresh(&m.viewport, content)
+		}
 		return
 	}
+	m.pagerMode = ModeNormal
+
+	// Set content
+	m.viewport.SetContent(content)
 
 	// Calculate maximum valid scroll position
 	maxOffset := m.viewport.TotalLineCount() - m.viewport.Height
@@ -1197,6 +5296,273 @@ func (m *model) updateViewport() {
 	}
 }
 
+// saveOnExit persists the open conversation, and the one a response was
+// streaming into, so the latest exchange isn't lost when quitting while a
+// request is in flight. A half-typed prompt is saved as a draft.
+func (m model) saveOnExit() error {
+	// Keep an unsent prompt for next time
+	if err := m.storage.SaveDraft(m.textInput.Value()); err != nil {
+		return err
+	}
+
+	convs := []*storage.Conversation{m.conversation}
+	if m.streamConv != nil && m.streamConv != m.conversation {
+		convs = append(convs, m.streamConv)
+	}
+
+	// A response still streaming in can be continued next time
+	if m.isLoading && m.streamConv != nil {
+		if reply := &m.streamConv.Messages[m.streamIndex]; reply.Content != "" {
+			reply.Truncated = "gpt-term closed mid-response"
+		}
+	}
+
+	for _, conv := range convs {
+		dropEmptyReply(conv)
+
+		// Nothing worth keeping in a chat that was never used
+		if !hasUserMessage(conv) {
+			continue
+		}
+
+		if conv.Summary == "" {
+			conv.Summary = m.storage.GenerateConversationSummary(conv.Messages)
+		}
+		err := m.storage.SaveConversation(conv)
+		var conflict *storage.ConflictError
+		if errors.As(err, &conflict) {
+			err = m.storage.SaveAsCopy(conv)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Everything is saved, so there's nothing to recover next time
+	return m.storage.ClearRecovery()
+}
+
+// dropEmptyReply removes the reply placeholder of a request that never got an
+// answer
+func dropEmptyReply(conv *storage.Conversation) {
+	if last := len(conv.Messages) - 1; last >= 0 && conv.Messages[last].Role == "assistant" && conv.Messages[last].Content == "" {
+		conv.Messages = conv.Messages[:last]
+	}
+}
+
+// showToast shows a short message under the conversation that goes away by
+// itself
+func (m *model) showToast(text string, isError bool) {
+	m.toast = text
+	m.toastIsError = isError
+	m.toastID++
+}
+
+// fail keeps err and shows it in a toast
+func (m *model) fail(err error) {
+	m.err = err
+	m.showToast(err.Error(), true)
+}
+
+// hasUserMessage reports whether the user said anything in conv
+func hasUserMessage(conv *storage.Conversation) bool {
+	for _, msg := range conv.Messages {
+		if msg.Role == "user" {
+			return true
+		}
+	}
+	return false
+}
+
+// recoveryTick schedules the next write of the recovery file
+func recoveryTick() tea.Cmd {
+	return tea.Tick(recoveryInterval, func(time.Time) tea.Msg {
+		return recoveryTickMsg{}
+	})
+}
+
+// writeRecovery snapshots the open conversations, including one a response is
+// still streaming into, so they can be recovered if gpt-term is killed
+func (m *model) writeRecovery() {
+	convs := []*storage.Conversation{m.conversation}
+	if m.streamConv != nil && m.streamConv != m.conversation {
+		convs = append(convs, m.streamConv)
+	}
+
+	var snapshot []storage.Conversation
+	for _, conv := range convs {
+		if hasUserMessage(conv) {
+			snap := *conv
+			snap.Messages = append([]storage.Message(nil), conv.Messages...)
+			snapshot = append(snapshot, snap)
+		}
+	}
+	if len(snapshot) == 0 {
+		return
+	}
+
+	// Skip the write when nothing changed since the last one
+	data, err := json.Marshal(snapshot)
+	if err != nil || string(data) == m.lastRecovery {
+		return
+	}
+	if err := m.storage.SaveRecovery(snapshot); err != nil {
+		m.fail(err)
+		return
+	}
+	m.lastRecovery = string(data)
+}
+
+// recover saves the conversations left by a session that was killed and opens
+// the last one. Ones that had been saved in full already are left alone.
+func (m *model) recover() {
+	var opened *storage.Conversation
+	for i := range m.recovered {
+		conv := &m.recovered[i]
+		dropEmptyReply(conv)
+		if onDisk, err := m.storage.LoadConversation(conv.ID); err == nil {
+			if len(onDisk.Messages) >= len(conv.Messages) {
+				opened = onDisk
+				continue
+			}
+			// The recovered copy is newer than the saved one
+			conv.Version = onDisk.Version
+		}
+		if conv.Summary == "" {
+			conv.Summary = m.storage.GenerateConversationSummary(conv.Messages)
+		}
+		m.saveConversation(conv)
+		opened = conv
+	}
+	if opened != nil {
+		m.openConversation(opened)
+	}
+	m.notice = fmt.Sprintf("Recovered %d conversation(s)", len(m.recovered))
+}
+
+// copyToClipboard copies text and reports it with a toast naming what was
+// copied
+func copyToClipboard(text, what string) tea.Cmd {
+	cmd, err := getClipboardCommand()
+	if err != nil {
+		return func() tea.Msg { return copiedMsg{err: err} }
+	}
+	cmd.Stdin = strings.NewReader(text)
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		return copiedMsg{what: what, err: err}
+	})
+}
+
+// transcript formats a command run as a fenced console session: the command
+// after a prompt, its output and how it exited
+func transcript(command, output string, exitCode int, truncated bool) string {
+	var s strings.Builder
+	s.WriteString("```console\n")
+	for i, line := range strings.Split(strings.TrimRight(command, "\n"), "\n") {
+		if i == 0 {
+			s.WriteString("$ " + line + "\n")
+		} else {
+			s.WriteString("> " + line + "\n")
+		}
+	}
+	if output = strings.TrimRight(output, "\n"); output != "" {
+		s.WriteString(output + "\n")
+	}
+	switch {
+	case truncated:
+		s.WriteString("# output cut off, command killed\n")
+	case exitCode < 0:
+		s.WriteString("# killed or couldn't start\n")
+	default:
+		fmt.Fprintf(&s, "# exit status %d\n", exitCode)
+	}
+	s.WriteString("```\n")
+	return s.String()
+}
+
+// pipeConversation runs pipe_command with the open conversation on stdin, as
+// markdown or JSON
+func (m *model) pipeConversation() tea.Cmd {
+	if m.config.PipeCommand == "" {
+		m.notice = "Set pipe_command in the config to send conversations to your own tools"
+		return nil
+	}
+	if !hasUserMessage(m.conversation) {
+		m.notice = "Nothing to send yet"
+		return nil
+	}
+
+	var data []byte
+	if m.config.PipeFormat == "json" {
+		var err error
+		data, err = json.MarshalIndent(m.conversation, "", "  ")
+		if err != nil {
+			m.fail(fmt.Errorf("error encoding conversation: %w", err))
+			return nil
+		}
+	} else {
+		data = []byte(conversationMarkdown(m.conversation))
+	}
+
+	cmdStr := strings.NewReplacer(
+		"{id}", shellQuote(m.conversation.ID),
+		"{summary}", shellQuote(m.conversation.Summary),
+	).Replace(m.config.PipeCommand)
+	dir, err := m.commandDir()
+	if err != nil {
+		m.notice = err.Error()
+		return nil
+	}
+	cmd := exec.Command(commandShell, "-c", cmdStr)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(data)
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		return pipedMsg{err: err}
+	})
+}
+
+// conversationMarkdown writes conv out as markdown, a heading per message.
+// Dividers become rules and the system prompt is left out.
+func conversationMarkdown(conv *storage.Conversation) string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "# %s\n\n", conv.Summary)
+	fmt.Fprintf(&s, "Started %s\n", conv.CreatedAt.Format("2006-01-02 15:04:05"))
+	for _, msg := range conv.Messages {
+		switch msg.Role {
+		case "system":
+			continue
+		case dividerRole:
+			fmt.Fprintf(&s, "\n---\n\n**%s**\n", msg.Content)
+			continue
+		case "user":
+			s.WriteString("\n## You\n\n")
+		default:
+			s.WriteString("\n## Assistant\n\n")
+		}
+		s.WriteString(strings.TrimSpace(msg.Content) + "\n")
+	}
+	return s.String()
+}
+
+// shellQuote single-quotes s for sh, escaping any single quotes in it
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// getOpenCommand returns the command that opens path with the OS's default
+// application
+func getOpenCommand(path string) (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", path), nil
+	case "linux":
+		return exec.Command("xdg-open", path), nil
+	case "windows":
+		return exec.Command("explorer", path), nil
+	default:
+		return nil, fmt.Errorf("unsupported platform for opening files")
+	}
+}
+
 func getClipboardCommand() (*exec.Cmd, error) {
 	switch runtime.GOOS {
 	case "darwin":
@@ -1210,9 +5576,280 @@ func getClipboardCommand() (*exec.Cmd, error) {
 	}
 }
 
+// getPasteCommand returns the command that prints the clipboard contents,
+// picking whichever tool is installed on Linux
+func getPasteCommand() (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("pbpaste"), nil
+	case "linux":
+		if _, err := exec.LookPath("wl-paste"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+			return exec.Command("wl-paste", "--no-newline"), nil
+		}
+		if _, err := exec.LookPath("xclip"); err == nil {
+			return exec.Command("xclip", "-selection", "clipboard", "-o"), nil
+		}
+		if _, err := exec.LookPath("xsel"); err == nil {
+			return exec.Command("xsel", "--clipboard", "--output"), nil
+		}
+		return nil, fmt.Errorf("no clipboard tool found, install xclip, xsel or wl-clipboard")
+	case "windows":
+		return exec.Command("powershell", "-NoProfile", "-Command", "Get-Clipboard"), nil
+	default:
+		return nil, fmt.Errorf("unsupported platform for clipboard operations")
+	}
+}
+
+// attachShellHistory attaches the user's last few shell commands to the next
+// prompt, if they opted in with shell_history. Pressing it again removes it.
+func (m *model) attachShellHistory() tea.Cmd {
+	if m.attachment != "" {
+		m.attachment = ""
+		m.notice = m.attachmentName + " removed"
+		return nil
+	}
+	if m.config.ShellHistory <= 0 {
+		m.notice = "Set shell_history in the config to attach your recent shell commands"
+		return nil
+	}
+
+	commands, err := shellhistory.Recent(m.config.ShellHistory)
+	if err != nil {
+		m.notice = "Couldn't read shell history: " + err.Error()
+		return nil
+	}
+	if len(commands) == 0 {
+		m.notice = "Your shell history is empty"
+		return nil
+	}
+	m.attachment = "My most recent shell commands, oldest first:\n```\n" + strings.Join(commands, "\n") + "\n```"
+	m.attachmentName = fmt.Sprintf("Shell history (%d commands)", len(commands))
+	return nil
+}
+
+// readClipboard reads the system clipboard in the background
+func readClipboard() tea.Cmd {
+	return func() tea.Msg {
+		cmd, err := getPasteCommand()
+		if err != nil {
+			return clipboardMsg{err: err}
+		}
+		output, err := cmd.Output()
+		if err != nil {
+			return clipboardMsg{err: fmt.Errorf("error running %s: %w", cmd.Path, err)}
+		}
+		return clipboardMsg{text: string(output)}
+	}
+}
+
+// newClient creates the API client with the model from the config
+func newClient(cfg *config.Config, apiKey string) *claude.Client {
+	opts := []claude.Option{claude.WithAPIKey(apiKey)}
+	if cfg.Model != "" {
+		opts = append(opts, claude.WithModel(cfg.Model))
+	}
+	if cfg.ThinkingBudget > 0 {
+		opts = append(opts, claude.WithThinking(cfg.ThinkingBudget))
+	}
+	if cfg.MaxTokens > 0 {
+		opts = append(opts, claude.WithMaxTokens(cfg.MaxTokens))
+	}
+	if cfg.BaseURL != "" {
+		opts = append(opts, claude.WithBaseURL(cfg.BaseURL))
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, claude.WithHeaders(cfg.Headers))
+	}
+	if cfg.APIVersion != "" {
+		opts = append(opts, claude.WithAPIVersion(cfg.APIVersion))
+	}
+	return claude.NewClient(opts...)
+}
+
+// resolveAPIKey looks for the API key in CLAUDE_API_KEY, then the OS
+// keychain, then the config file
+func resolveAPIKey(cfg *config.Config) string {
+	if apiKey := os.Getenv("CLAUDE_API_KEY"); apiKey != "" {
+		return apiKey
+	}
+	if apiKey, err := keychain.Get(); err == nil && apiKey != "" {
+		return apiKey
+	}
+	return cfg.APIKey
+}
+
+// readAPIKey prompts for the API key without echoing it
+func readAPIKey() (string, error) {
+	fmt.Print("Claude API key (input is hidden): ")
+	keyBytes, err := term.ReadPassword(os.Stdin.Fd())
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("error reading API key: %w", err)
+	}
+	apiKey := strings.TrimSpace(string(keyBytes))
+	if apiKey == "" {
+		return "", fmt.Errorf("an API key is required, get one at https://console.anthropic.com")
+	}
+	return apiKey, nil
+}
+
+// runSetup asks a first-time user for their API key, model and editor and
+// writes them to the config file. It returns the key to use for this session.
+func runSetup(cfg *config.Config) (string, error) {
+	fmt.Println("Welcome to gpt-term! Let's get you set up.")
+	fmt.Println()
+
+	apiKey, err := readAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	ask := func(question, def string) string {
+		fmt.Printf("%s [%s]: ", question, def)
+		answer, _ := reader.ReadString('\n')
+		if answer = strings.TrimSpace(answer); answer != "" {
+			return answer
+		}
+		return def
+	}
+
+	if model := ask("Model", claude.DefaultModel); model != claude.DefaultModel {
+		cfg.Model = model
+	}
+	if editor := ask("Editor", defaultEditor()); editor != defaultEditor() {
+		cfg.Editor = editor
+	}
+
+	yes := func(answer string) bool {
+		return strings.HasPrefix(strings.ToLower(answer), "y")
+	}
+	stored := false
+	if yes(ask("Store the API key in the OS keychain? (y/n)", "y")) {
+		if err := keychain.Set(apiKey); err != nil {
+			fmt.Printf("Couldn't use the keychain: %v\n", err)
+		} else {
+			stored = true
+		}
+	}
+	if !stored {
+		if yes(ask("Save the API key in the config file, readable only by you? (y/n)", "y")) {
+			cfg.APIKey = apiKey
+		} else {
+			fmt.Println("To avoid entering it again, add this to your shell's rc file (e.g. ~/.zshrc):")
+			fmt.Println("  export CLAUDE_API_KEY='your-api-key-here'")
+		}
+	}
+
+	if err := config.Save(cfg); err != nil {
+		return "", err
+	}
+
+	path, _ := config.Path()
+	fmt.Printf("Saved config to %s\n\n", path)
+	return apiKey, nil
+}
+
+// rebuildIndex rebuilds the conversation index and lists the files it had to
+// skip
+func rebuildIndex() error {
+	store, err := storage.NewStorage()
+	if err != nil {
+		return fmt.Errorf("error creating storage: %w", err)
+	}
+	report, err := store.RebuildIndex()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Indexed %d conversation(s)\n", report.Indexed)
+	if len(report.Failed) > 0 {
+		fmt.Printf("Skipped %d file(s) that couldn't be read:\n", len(report.Failed))
+		for _, failure := range report.Failed {
+			fmt.Printf("  %s: %v\n", failure.File, failure.Err)
+		}
+	}
+	return nil
+}
+
+// runCheck sends a tiny request with each configured model and prints
+// whether the API key, the base URL and the models work, for --check. It
+// reports false if anything failed.
+func runCheck(cfg *config.Config) bool {
+	pass := func(format string, args ...any) { fmt.Printf("✓ "+format+"\n", args...) }
+	fail := func(format string, args ...any) { fmt.Printf("✗ "+format+"\n", args...) }
+
+	apiKey := resolveAPIKey(cfg)
+	if apiKey == "" {
+		fail("No API key found. Set CLAUDE_API_KEY or run gpt-term --set-key")
+		return false
+	}
+	pass("API key found")
+
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = claude.BaseURL
+	}
+	models := []string{cfg.Model}
+	if cfg.Model == "" {
+		models[0] = claude.DefaultModel
+	}
+	if cfg.FallbackModel != "" {
+		models = append(models, cfg.FallbackModel)
+	}
+
+	// One token is enough to know the model answers, and thinking would need more
+	checkCfg := *cfg
+	checkCfg.MaxTokens = 1
+	checkCfg.ThinkingBudget = 0
+
+	ok := true
+	reached := false
+	for _, model := range models {
+		checkCfg.Model = model
+		_, err := newClient(&checkCfg, apiKey).CreateMessage([]claude.Message{{Role: "user", Content: "Hi"}})
+		var apiErr *claude.APIError
+		var empty *claude.EmptyResponseError
+		switch {
+		case err == nil || errors.As(err, &empty):
+			if !reached {
+				pass("%s is reachable and accepts the API key", baseURL)
+				reached = true
+			}
+			pass("%s answers", model)
+		case !errors.As(err, &apiErr):
+			fail("Couldn't reach %s: %v", baseURL, err)
+			return false
+		case apiErr.StatusCode == 401 || apiErr.StatusCode == 403:
+			fail("%s rejected the API key: %v", baseURL, err)
+			return false
+		case apiErr.StatusCode == 404:
+			fail("%s isn't available: %v", model, err)
+			ok = false
+		default:
+			fail("Request to %s failed: %v", model, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
 func main() {
 	// Add version flag
 	versionFlag := flag.Bool("version", false, "Print version information")
+	setKeyFlag := flag.Bool("set-key", false, "Store the API key in the OS keychain and exit")
+	cacheFlag := flag.Bool("cache", false, "Reuse stored answers to identical requests instead of calling the API")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "How long cached answers are kept with --cache")
+	contextMessages := flag.Int("context-messages", -1, "Only send this many of the most recent messages with each request (0 sends all)")
+	personaFlag := flag.String("persona", "", "Start new chats with this built-in persona: "+persona.Names())
+	debugFlag := flag.Bool("debug", false, "Let Alt+Q show the last request sent to the API, with the key redacted")
+	openFlag := flag.String("open", "", "Open the conversation whose ID starts with this, or whose summary matches it")
+	compactFlag := flag.Bool("compact", false, "Use a compact layout without scroll indicators and key hints, for small terminals")
+	rebuildIndexFlag := flag.Bool("rebuild-index", false, "Rebuild the conversation index, reporting unreadable conversation files, and exit")
+	apiVersionFlag := flag.String("api-version", "", "Send this anthropic-version header, e.g. to use a newer API version (default "+claude.DefaultAPIVersion+")")
+	contextFileFlag := flag.String("context-file", "", "Start a chat with this file, e.g. a project's README, as context")
+	minimalFlag := flag.Bool("minimal-ui", false, "Show only the conversation and a bare input, without title, scroll indicators and key hints, e.g. for recordings")
+	checkFlag := flag.Bool("check", false, "Check that the API key, base URL and models work with a tiny request, and exit")
 	flag.Parse()
 
 	if *versionFlag {
@@ -1220,21 +5857,133 @@ func main() {
 		os.Exit(0)
 	}
 
-	if os.Getenv("CLAUDE_API_KEY") == "" {
-		fmt.Println("Error: CLAUDE_API_KEY environment variable is not defined")
+	if *rebuildIndexFlag {
+		if err := rebuildIndex(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *setKeyFlag {
+		apiKey, err := readAPIKey()
+		if err == nil {
+			err = keychain.Set(apiKey)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("API key stored in the keychain")
+		os.Exit(0)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Printf("Error loading config: %v\n", err)
 		os.Exit(1)
 	}
+	applyTheme(cfg.Theme)
+	if *apiVersionFlag != "" {
+		if err := config.ValidateAPIVersion(*apiVersionFlag); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.APIVersion = *apiVersionFlag
+	}
+
+	if *checkFlag {
+		if !runCheck(cfg) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	apiKey := resolveAPIKey(cfg)
+	if apiKey == "" {
+		// Walk new users through setup instead of just failing
+		if config.Exists() || !term.IsTerminal(os.Stdin.Fd()) {
+			fmt.Println("Error: no API key found. Set CLAUDE_API_KEY or run gpt-term --set-key")
+			os.Exit(1)
+		}
+		apiKey, err = runSetup(cfg)
+		if err != nil {
+			fmt.Printf("Error during setup: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *contextMessages >= 0 {
+		cfg.ContextMessages = *contextMessages
+	}
+	if *compactFlag {
+		cfg.Compact = true
+	}
+	if *minimalFlag {
+		cfg.MinimalUI = true
+	}
+	if *personaFlag != "" {
+		if err := config.ValidatePersona(*personaFlag); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.Persona = *personaFlag
+	}
+	if p, ok := persona.Find(cfg.Persona); ok {
+		cfg.Persona = p.Name
+	}
+
+	var respCache *cache.Cache
+	if *cacheFlag {
+		respCache, err = cache.New(*cacheTTL)
+		if err != nil {
+			fmt.Printf("Error creating cache: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	m, err := initialModel()
+	m, err := initialModel(cfg, apiKey, respCache)
 	if err != nil {
 		fmt.Printf("Error initializing model: %v\n", err)
 		os.Exit(1)
 	}
+	m.debug = *debugFlag
+	if dir, temporary, err := appdir.Dir(); err == nil && temporary {
+		m.notice = "No home directory, conversations are kept in " + dir + " and may not survive a reboot (set GPT_TERM_DIR)"
+	}
+	if *contextFileFlag != "" {
+		if *openFlag != "" {
+			fmt.Println("Error: --context-file starts a new chat, it can't be used with --open")
+			os.Exit(1)
+		}
+		path, content, warning, err := readContextFile(*contextFileFlag)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		seedContext(m.conversation, path, content)
+		m.messages = m.conversation.Messages
+		m.notice = "Chatting with " + filepath.Base(path) + " as context"
+		if warning != "" {
+			m.notice = "Warning: " + warning
+		}
+	}
+	if *openFlag != "" {
+		if err := m.openMatching(*openFlag); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	p := tea.NewProgram(m,
 		tea.WithAltScreen(),
 	)
-	if _, err := p.Run(); err != nil {
+	finalModel, err := p.Run()
+	if fm, ok := finalModel.(model); ok {
+		if err := fm.saveOnExit(); err != nil {
+			fmt.Printf("Error saving conversation: %v\n", err)
+		}
+	}
+	if err != nil {
 		fmt.Printf("Error running program: %v\n", err)
 		os.Exit(1)
 	}
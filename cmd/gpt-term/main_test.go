@@ -0,0 +1,270 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gpt-term/internal/config"
+	"gpt-term/internal/storage"
+)
+
+func TestCommandTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "plain",
+			content: "List them:\n<command>ls -la</command>",
+			want:    []string{"ls -la"},
+		},
+		{
+			name:    "quoted closing tag",
+			content: `<command>echo "</command>" > tag.txt</command>`,
+			want:    []string{`echo "</command>" > tag.txt`},
+		},
+		{
+			name:    "single quoted closing tag",
+			content: `<command>grep -c '</command>' reply.txt</command>`,
+			want:    []string{`grep -c '</command>' reply.txt`},
+		},
+		{
+			name:    "escaped closing tag",
+			content: `<command>echo &lt;command&gt;ls&lt;/command&gt;</command>`,
+			want:    []string{`echo <command>ls</command>`},
+		},
+		{
+			name:    "redirects",
+			content: `<command>sort < in.txt > out.txt 2>&1</command>`,
+			want:    []string{`sort < in.txt > out.txt 2>&1`},
+		},
+		{
+			name:    "tag-like text",
+			content: `<command>sed 's/<br>/\n/g' page.html</command>`,
+			want:    []string{`sed 's/<br>/\n/g' page.html`},
+		},
+		{
+			name:    "apostrophes in prose between commands",
+			content: "<command>ls</command>\nThat's it, but don't forget:\n<command>pwd</command>",
+			want:    []string{"ls", "pwd"},
+		},
+		{
+			name:    "unbalanced quote in a command followed by prose",
+			content: "<command>echo it's</command>\nIt's done, then:\n<command>pwd</command>",
+			want:    []string{"echo it's", "pwd"},
+		},
+		{
+			name:    "unclosed",
+			content: "<command>ls -la",
+			want:    nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, tag := range commandTags(tt.content) {
+				got = append(got, tag.text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commandTags(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"scp <file> user@YOUR_IP:~", []string{"<file>", "YOUR_IP"}},
+		{"cat <file> | grep <pattern> <file>", []string{"<file>", "<pattern>"}},
+		{"./deploy.sh $1", []string{"$1"}},
+		{"awk '{print $1}' access.log", nil},
+		{`sed 's/<br>/\n/g' page.html`, nil},
+		{"grep '<div>' index.html", nil},
+		{"tr a-z A-Z <in.txt>out.txt", nil},
+		{"sort <input file> > sorted.txt", []string{"<input file>"}},
+	}
+
+	for _, tt := range tests {
+		if got := placeholders(tt.cmd); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("placeholders(%q) = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestFencedCommandLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		console bool
+		want    []string
+	}{
+		{
+			name: "one per line",
+			code: "# Update first\nsudo apt update\n\n$ sudo apt upgrade\n",
+			want: []string{"sudo apt update", "sudo apt upgrade"},
+		},
+		{
+			name: "backslash continuation",
+			code: "docker run \\\n  -p 80:80 \\\n  nginx\n",
+			want: []string{"docker run -p 80:80 nginx"},
+		},
+		{
+			name: "loop",
+			code: "for f in *.jpg; do\n  convert \"$f\" \"${f%.jpg}.png\"\ndone\nls *.png\n",
+			want: []string{"for f in *.jpg; do\nconvert \"$f\" \"${f%.jpg}.png\"\ndone", "ls *.png"},
+		},
+		{
+			name: "loop with do on its own line",
+			code: "while read -r line\ndo\n  echo \"$line\"\ndone < list.txt\n",
+			want: []string{"while read -r line\ndo\necho \"$line\"\ndone < list.txt"},
+		},
+		{
+			name: "if",
+			code: "if [ -f ~/.bashrc ]; then\n  source ~/.bashrc\nfi\n",
+			want: []string{"if [ -f ~/.bashrc ]; then\nsource ~/.bashrc\nfi"},
+		},
+		{
+			name: "one-line loop",
+			code: "for i in 1 2 3; do echo $i; done\necho done\n",
+			want: []string{"for i in 1 2 3; do echo $i; done", "echo done"},
+		},
+		{
+			name: "heredoc",
+			code: "cat <<'EOF' > notes.txt\n  indented\nEOF\nwc -l notes.txt\n",
+			want: []string{"cat <<'EOF' > notes.txt\n  indented\nEOF", "wc -l notes.txt"},
+		},
+		{
+			name: "pipe at the end of a line",
+			code: "ps aux |\n  grep nginx\n",
+			want: []string{"ps aux |\ngrep nginx"},
+		},
+		{
+			name:    "console",
+			code:    "$ ls\nfile.txt\nnotes.md\n$ echo hi \\\n> there\nhi there\n",
+			console: true,
+			want:    []string{"ls", "echo hi there"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fencedCommandLines(tt.code, tt.console); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fencedCommandLines(%q) = %q, want %q", tt.code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractPaths(t *testing.T) {
+	content := "Edit ~/.bashrc, then run:\n" +
+		"```bash\nsource ~/.bashrc && cat /etc/hosts\n```\n" +
+		"| File | Purpose |\n|---|---|\n| src/main.go | entry point |\n" +
+		"<command>ls /var/log</command>\n" +
+		"Logs are in /var/log/syslog."
+	want := []string{"~/.bashrc", "/var/log/syslog"}
+	if got := extractPaths(content); !reflect.DeepEqual(got, want) {
+		t.Errorf("extractPaths() = %q, want %q", got, want)
+	}
+}
+
+func TestMacroExecuteNeedsAutoExecute(t *testing.T) {
+	m := model{
+		config: config.Default(),
+		mode:   ModeNormal,
+		macro:  []string{"execute", "follow-up"},
+		messages: []storage.Message{
+			{Role: "user", Content: "What was built?"},
+			{Role: "assistant", Content: "<command>ls build</command>"},
+		},
+	}
+	m.config.AutoExecute = false
+
+	updated, cmd := m.nextMacroStep()
+	next := updated.(model)
+	if cmd != nil {
+		t.Error("the command was run without auto_execute")
+	}
+	if next.mode != ModeCommandSelect {
+		t.Errorf("mode = %v, want the selection to confirm the command", next.mode)
+	}
+	if len(next.macro) != 0 {
+		t.Errorf("macro = %q, want it stopped", next.macro)
+	}
+}
+
+func TestFillPlaceholderText(t *testing.T) {
+	tests := []struct {
+		cmd, placeholder, value, want string
+	}{
+		{"cat <file>", "<file>", "notes.txt", "cat 'notes.txt'"},
+		{"cat <file>", "<file>", "a b; rm -rf ~", "cat 'a b; rm -rf ~'"},
+		{"cat <file>", "<file>", "it's.txt", `cat 'it'\''s.txt'`},
+		{"cp <file> <file>.bak", "<file>", "x", "cp 'x' 'x'.bak"},
+		{`grep '<file>' <file>`, "<file>", "log.txt", `grep '<file>' 'log.txt'`},
+		{`echo "Hello <name>"`, "<name>", `$(id) "x"`, `echo "Hello \$(id) \"x\""`},
+		{"ssh root@YOUR_IP", "YOUR_IP", "10.0.0.1", "ssh root@'10.0.0.1'"},
+	}
+
+	for _, tt := range tests {
+		if got := fillPlaceholderText(tt.cmd, tt.placeholder, tt.value); got != tt.want {
+			t.Errorf("fillPlaceholderText(%q, %q, %q) = %q, want %q", tt.cmd, tt.placeholder, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestUnsetVariableCommandEnv(t *testing.T) {
+	const name = "GPT_TERM_TEST_DEPLOY_HOST"
+	cmd := "ssh $" + name
+
+	if got := unsetVariable(cmd, commandEnv(nil)); got != name {
+		t.Errorf("unsetVariable() without command_env = %q, want %q", got, name)
+	}
+	env := commandEnv(map[string]string{name: "example.com"})
+	if got := unsetVariable(cmd, env); got != "" {
+		t.Errorf("unsetVariable() with command_env = %q, want it set", got)
+	}
+	vars, _ := commandExpansions(cmd, env)
+	if len(vars) != 1 || vars[0].value != "example.com" {
+		t.Errorf("commandExpansions() = %+v, want $%s = example.com", vars, name)
+	}
+}
+
+func TestOneLiner(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		want    string
+		wantErr bool
+	}{
+		{"continuation", "docker run \\\n  -it \\\n  ubuntu", "docker run -it ubuntu", false},
+		{"escaped backslash", "echo a\\\\\necho b", "echo a\\\\; echo b", false},
+		{"escaped backslash then continuation", "echo a\\\\\\\n  b", "echo a\\\\ b", false},
+		{"pipe", "cat log |\n  grep err", "cat log | grep err", false},
+		{"for", "for f in *.txt; do\n  echo \"$f\"\ndone", "for f in *.txt; do echo \"$f\"; done", false},
+		{"if", "if [ -f x ]; then\n  echo yes\nelse\n  echo no\nfi", "if [ -f x ]; then echo yes; else echo no; fi", false},
+		{"case", "case $1 in\n  a) echo a;;\n  b)\n    echo b\n    ;;\nesac", "case $1 in a) echo a;; b) echo b ;; esac", false},
+		{"function", "greet() {\n  echo hi\n}", "greet() { echo hi; }", false},
+		{"command substitution", "files=$(\n  ls\n)", "files=$( ls; )", false},
+		{"comment line", "# build it\nmake\n\n# and test it\nmake test", "make; make test", false},
+		{"trailing comment", "make # build it\nmake test", "", true},
+		{"multi-line quote", "echo 'a\nb'", "", true},
+		{"heredoc", "cat <<EOF\nhi\nEOF", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := oneLiner(tt.cmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("oneLiner(%q) error = %v, want error %v", tt.cmd, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("oneLiner(%q) = %q, want %q", tt.cmd, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package appdir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	tempOnce sync.Once
+	tempDir  string
+	tempErr  error
+)
+
+// Dir returns the directory gpt-term keeps its config and conversations in:
+// $GPT_TERM_DIR if set, otherwise ~/.gpt-term. Without a home directory, e.g.
+// in a minimal container, it falls back to $XDG_DATA_HOME/gpt-term and then
+// to a temporary directory, reporting temporary since that may not last.
+func Dir() (dir string, temporary bool, err error) {
+	if dir := os.Getenv("GPT_TERM_DIR"); dir != "" {
+		return dir, false, nil
+	}
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(homeDir, ".gpt-term"), false, nil
+	}
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "gpt-term"), false, nil
+	}
+	tempOnce.Do(func() {
+		tempDir, tempErr = privateTempDir()
+	})
+	return tempDir, true, tempErr
+}
+
+// privateTempDir returns a directory in the system temp dir that only this
+// user can get into. Anyone can create directories there, and one planted
+// under our name could hand us a config that sends the API key elsewhere, so
+// the usual name is only used when it's really ours. Otherwise a fresh one
+// nobody can guess is made.
+func privateTempDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), tempName())
+	if err := os.Mkdir(dir, 0700); err == nil || errors.Is(err, os.ErrExist) {
+		if info, err := os.Lstat(dir); err == nil && private(dir, info) {
+			return dir, nil
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "gpt-term-")
+	if err != nil {
+		return "", fmt.Errorf("error creating a temporary directory: %w", err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package appdir
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// tempName is the name of this user's directory in the system temp dir
+func tempName() string {
+	return "gpt-term-" + strconv.Itoa(os.Getuid())
+}
+
+// private reports whether dir is a real directory owned by this user that
+// nobody else can get into. One that's ours but was left readable by others,
+// e.g. by an older gpt-term, is locked down as long as others couldn't write
+// to it.
+func private(dir string, info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.IsDir() || int(stat.Uid) != os.Getuid() {
+		return false
+	}
+	perm := info.Mode().Perm()
+	if perm&0022 != 0 {
+		return false
+	}
+	if perm&0077 != 0 {
+		return os.Chmod(dir, 0700) == nil
+	}
+	return true
+}
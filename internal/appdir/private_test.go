@@ -0,0 +1,61 @@
+//go:build !windows
+
+package appdir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrivate(t *testing.T) {
+	tests := []struct {
+		name string
+		perm os.FileMode
+		want bool
+	}{
+		{"private", 0700, true},
+		{"readable by others", 0755, true},
+		{"writable by others", 0777, false},
+		{"writable by the group", 0770, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "gpt-term")
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, tt.perm); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Lstat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := private(dir, info); got != tt.want {
+				t.Errorf("private() = %v, want %v", got, tt.want)
+			}
+			if tt.want {
+				if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+					t.Errorf("mode = %v, want it locked down to 0700", info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateSymlink(t *testing.T) {
+	target := t.TempDir()
+	link := filepath.Join(t.TempDir(), "gpt-term")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if private(link, info) {
+		t.Error("private() = true for a symlink")
+	}
+}
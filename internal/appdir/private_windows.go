@@ -0,0 +1,15 @@
+package appdir
+
+import "os"
+
+// tempName is the name of this user's directory in the system temp dir. The
+// temp dir is already the user's own on Windows, and Getuid is always -1.
+func tempName() string {
+	return "gpt-term"
+}
+
+// private reports whether dir is a real directory. The temp dir it's in
+// belongs to the user on Windows, so others can't have made it.
+func private(dir string, info os.FileInfo) bool {
+	return info.IsDir() && info.Mode()&os.ModeSymlink == 0
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gpt-term/internal/appdir"
+)
+
+// Entry is a cached response
+type Entry struct {
+	Text       string    `json:"text"`
+	Thinking   string    `json:"thinking,omitempty"`
+	StopReason string    `json:"stop_reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Cache stores responses on disk keyed by a hash of the request, so an
+// identical request can be answered without calling the API
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// New creates a cache in the cache directory under appdir.Dir whose entries
+// expire after ttl
+func New(ttl time.Duration) (*Cache, error) {
+	appDir, _, err := appdir.Dir()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(appDir, "cache")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+	return &Cache{dir: dir, ttl: ttl}, nil
+}
+
+// Key hashes everything that affects a response: the model, any other
+// settings and the messages, including the system prompt
+func Key(parts ...any) (string, error) {
+	data, err := json.Marshal(parts)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling cache key: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Get returns the entry stored under key, if there is one that hasn't expired
+func (c *Cache) Get(key string) (Entry, bool) {
+	var entry Entry
+	data, err := os.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, false
+	}
+	if time.Since(entry.CreatedAt) > c.ttl {
+		os.Remove(filepath.Join(c.dir, key+".json"))
+		return entry, false
+	}
+	return entry, true
+}
+
+// Put stores entry under key
+func (c *Cache) Put(key string, entry Entry) error {
+	entry.CreatedAt = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshaling cache entry: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, key+".json"), data, 0600); err != nil {
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+	return nil
+}
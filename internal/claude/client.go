@@ -1,21 +1,77 @@
 package claude
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	BaseURL = "https://api.anthropic.com/v1/messages"
+	BaseURL      = "https://api.anthropic.com/v1/messages"
+	DefaultModel = "claude-3-sonnet-20240229"
+	// DefaultMaxTokens caps the length of responses unless set otherwise
+	DefaultMaxTokens = 1000
+	// DefaultAPIVersion is sent as the anthropic-version header unless set
+	// otherwise
+	DefaultAPIVersion = "2023-06-01"
+
+	// MaxAttempts is how many times a request is tried when the API is
+	// overloaded or rate limiting
+	MaxAttempts = 3
 )
 
+// RetryInfo describes a failed attempt that is about to be retried
+type RetryInfo struct {
+	Attempt     int // The attempt that will be made next
+	MaxAttempts int
+	Wait        time.Duration
+	Reason      string
+}
+
+// StreamHandler receives a streamed response as it arrives. Any of the
+// functions can be nil.
+type StreamHandler struct {
+	OnText     func(string)
+	OnThinking func(string)    // The model's reasoning, when extended thinking is on
+	OnRetry    func(RetryInfo) // Called before waiting to retry a failed attempt
+}
+
 type Client struct {
 	apiKey     string
+	baseURL    string
+	model      string
+	headers    map[string]string
+	apiVersion string
 	httpClient *http.Client
+	// thinkingBudget enables extended thinking with this many tokens, 0 is off
+	thinkingBudget int
+	maxTokens      int
+
+	mu          sync.Mutex
+	rateLimit   RateLimit
+	lastRequest *CreateMessageRequest // The last request sent, for debugging
+}
+
+// RateLimit holds the rate limit state reported by the last API response.
+// Zero values mean the header wasn't present.
+type RateLimit struct {
+	RequestsLimit     int
+	RequestsRemaining int
+	RequestsReset     time.Time
+	TokensLimit       int
+	TokensRemaining   int
+	TokensReset       time.Time
 }
 
 type Message struct {
@@ -28,23 +84,208 @@ type CreateMessageRequest struct {
 	Messages  []Message `json:"messages"`
 	MaxTokens int       `json:"max_tokens"`
 	System    string    `json:"system,omitempty"`
+	Stream    bool      `json:"stream,omitempty"`
+	Thinking  *Thinking `json:"thinking,omitempty"`
+	// Temperature is left to the API's default when nil
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// Thinking enables extended thinking, where the model reasons before answering
+type Thinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
 }
 
 type CreateMessageResponse struct {
 	Content []struct {
-		Text string `json:"text"`
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"`
 	} `json:"content"`
-	Role string `json:"role"`
+	Role       string `json:"role"`
+	StopReason string `json:"stop_reason"`
+	Usage      Usage  `json:"usage"`
 }
 
-func NewClient() *Client {
-	return &Client{
+// Usage is the number of tokens a request consumed
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Response is a complete (or interrupted) streamed response
+type Response struct {
+	Text       string
+	Thinking   string // The model's reasoning, when extended thinking is on
+	StopReason string
+	Usage      Usage
+}
+
+// streamEvent is the payload of a server-sent event in a streamed response
+type streamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage Usage `json:"usage"`
+	} `json:"message"`
+	Usage Usage `json:"usage"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		Thinking   string `json:"thinking"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// ErrStreamInterrupted is returned by StreamMessage when the connection drops
+// before the response is complete. The text received so far is returned with it.
+var ErrStreamInterrupted = errors.New("stream interrupted before the response was complete")
+
+// Option customizes a Client created by NewClient
+type Option func(*Client)
+
+// WithAPIKey sets the API key instead of reading CLAUDE_API_KEY
+func WithAPIKey(apiKey string) Option {
+	return func(c *Client) {
+		c.apiKey = apiKey
+	}
+}
+
+// WithBaseURL sends requests to url instead of BaseURL
+func WithBaseURL(url string) Option {
+	return func(c *Client) {
+		c.baseURL = url
+	}
+}
+
+// WithHeaders adds extra headers to every request, e.g. the auth a gateway
+// needs. They can replace the default ones.
+func WithHeaders(headers map[string]string) Option {
+	return func(c *Client) {
+		c.headers = headers
+	}
+}
+
+// WithAPIVersion sends version as the anthropic-version header instead of
+// DefaultAPIVersion, e.g. for features only newer versions have
+func WithAPIVersion(version string) Option {
+	return func(c *Client) {
+		c.apiVersion = version
+	}
+}
+
+// WithModel uses model instead of DefaultModel
+func WithModel(model string) Option {
+	return func(c *Client) {
+		c.model = model
+	}
+}
+
+// WithMaxTokens caps responses at maxTokens instead of DefaultMaxTokens
+func WithMaxTokens(maxTokens int) Option {
+	return func(c *Client) {
+		c.maxTokens = maxTokens
+	}
+}
+
+// WithThinking turns on extended thinking with a budget of tokens the model
+// can spend reasoning. The API requires at least 1024.
+func WithThinking(budgetTokens int) Option {
+	return func(c *Client) {
+		c.thinkingBudget = budgetTokens
+	}
+}
+
+// WithHTTPClient makes requests through httpClient, e.g. one pointed at an
+// httptest.Server or with custom transport settings
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// EmptyResponseError is returned when the API answers successfully but
+// without any text, which can happen on some stop conditions
+type EmptyResponseError struct {
+	StopReason string
+}
+
+func (e *EmptyResponseError) Error() string {
+	if e.StopReason == "" {
+		return "the model returned no text, try rephrasing"
+	}
+	return fmt.Sprintf("the model returned no text (stop reason: %s), try rephrasing", e.StopReason)
+}
+
+// APIError is an error reported by the API, either as a failed request or
+// as an error event in a stream
+type APIError struct {
+	StatusCode int    // 0 for errors reported mid-stream
+	Type       string // e.g. "overloaded_error", empty if the body wasn't JSON
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Overloaded() && e.StatusCode == 0 {
+		return "Anthropic got overloaded mid-response, try again in a bit"
+	}
+	if e.Overloaded() {
+		return fmt.Sprintf("Anthropic is overloaded right now (tried %d times), try again in a bit", MaxAttempts)
+	}
+	if e.Type == "" {
+		return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("API error (%s): %s", e.Type, e.Message)
+}
+
+// Overloaded reports whether the API was too busy to answer, a transient
+// condition that's common at peak times
+func (e *APIError) Overloaded() bool {
+	return e.Type == "overloaded_error" || e.StatusCode == 529
+}
+
+// newAPIError parses the error body of a failed request
+func newAPIError(statusCode int, body []byte) *APIError {
+	var parsed struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.Error.Type == "" {
+		return &APIError{StatusCode: statusCode, Message: string(body)}
+	}
+	return &APIError{StatusCode: statusCode, Type: parsed.Error.Type, Message: parsed.Error.Message}
+}
+
+func NewClient(opts ...Option) *Client {
+	c := &Client{
 		apiKey:     os.Getenv("CLAUDE_API_KEY"),
+		baseURL:    BaseURL,
+		model:      DefaultModel,
+		maxTokens:  DefaultMaxTokens,
+		apiVersion: DefaultAPIVersion,
 		httpClient: &http.Client{},
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-func (c *Client) CreateMessage(messages []Message) (string, error) {
+// Params override the client's settings for one request, e.g. with a
+// conversation's own. Zero values keep the client's.
+type Params struct {
+	Model       string
+	MaxTokens   int
+	Temperature *float64
+}
+
+// newRequest builds the request for messages with params applied
+func (c *Client) newRequest(messages []Message, params Params) CreateMessageRequest {
 	// Filter out system messages and use the last one as system parameter
 	var systemMsg string
 	var filteredMsgs []Message
@@ -56,30 +297,214 @@ func (c *Client) CreateMessage(messages []Message) (string, error) {
 		}
 	}
 
-	reqBody := CreateMessageRequest{
-		Model:     "claude-3-sonnet-20240229",
-		Messages:  filteredMsgs,
-		MaxTokens: 1000,
-		System:    systemMsg,
+	req := CreateMessageRequest{
+		Model:       c.model,
+		Messages:    filteredMsgs,
+		MaxTokens:   c.maxTokens,
+		System:      systemMsg,
+		Temperature: params.Temperature,
 	}
+	if params.Model != "" {
+		req.Model = params.Model
+	}
+	if params.MaxTokens > 0 {
+		req.MaxTokens = params.MaxTokens
+	}
+
+	// Thinking can't be used to continue a prefilled assistant message, and
+	// the budget comes out of max_tokens so raise it to leave room for the answer
+	last := len(filteredMsgs) - 1
+	if c.thinkingBudget > 0 && last >= 0 && filteredMsgs[last].Role == "user" {
+		req.Thinking = &Thinking{Type: "enabled", BudgetTokens: c.thinkingBudget}
+		req.MaxTokens += c.thinkingBudget
+		// The API only allows the default temperature with thinking
+		req.Temperature = nil
+	}
+	return req
+}
 
+// sendWithRetry sends a request, retrying with exponential backoff while the
+// API is rate limiting or overloaded. onRetry, if set, is told about each
+// wait. Cancelling ctx gives up, including during a wait.
+func (c *Client) sendWithRetry(ctx context.Context, reqBody CreateMessageRequest, onRetry func(RetryInfo)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, reqBody)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var reason string
+		switch {
+		case err != nil:
+			reason = "connection failed"
+		case resp.StatusCode == http.StatusTooManyRequests:
+			reason = "rate limited"
+		case resp.StatusCode == 529:
+			reason = "Anthropic is overloaded"
+		case resp.StatusCode >= 500:
+			reason = fmt.Sprintf("server error %d", resp.StatusCode)
+		default:
+			return resp, nil
+		}
+		if attempt == MaxAttempts {
+			return resp, err
+		}
+
+		// Wait as long as the API asks to, or back off 1s, 2s, 4s...
+		wait := time.Second << (attempt - 1)
+		if resp != nil {
+			if secs, err := strconv.Atoi(resp.Header.Get("retry-after")); err == nil && secs > 0 {
+				wait = time.Duration(secs) * time.Second
+			}
+			resp.Body.Close()
+		}
+		if onRetry != nil {
+			onRetry(RetryInfo{Attempt: attempt + 1, MaxAttempts: MaxAttempts, Wait: wait, Reason: reason})
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// buildRequest turns reqBody into the HTTP request that's sent to the API
+func (c *Client) buildRequest(ctx context.Context, reqBody CreateMessageRequest) (*http.Request, error) {
 	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("error marshaling request: %w", err)
+		return nil, fmt.Errorf("error marshaling request: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", BaseURL, bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL, bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
+		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-api-key", c.apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
+	req.Header.Set("anthropic-version", c.apiVersion)
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+func (c *Client) send(ctx context.Context, reqBody CreateMessageRequest) (*http.Response, error) {
+	req, err := c.buildRequest(ctx, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.lastRequest = &reqBody
+	c.mu.Unlock()
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error making request: %w", err)
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+
+	c.mu.Lock()
+	c.rateLimit = parseRateLimit(resp.Header)
+	c.mu.Unlock()
+
+	return resp, nil
+}
+
+// DebugRequest describes the HTTP request the client sent last, with its
+// headers and indented JSON body, and reports true. Before anything was sent,
+// it describes the streaming request messages would be sent as instead, with
+// params like StreamMessage. Keys
+// and other secrets in the headers are redacted, so it can be shared in an issue.
+func (c *Client) DebugRequest(messages []Message, params Params) (string, bool, error) {
+	c.mu.Lock()
+	last := c.lastRequest
+	c.mu.Unlock()
+
+	reqBody := c.newRequest(messages, params)
+	reqBody.Stream = true
+	if last != nil {
+		reqBody = *last
+	}
+
+	// Only built, never sent
+	req, err := c.buildRequest(context.Background(), reqBody)
+	if err != nil {
+		return "", false, err
+	}
+
+	var s strings.Builder
+	s.WriteString(req.Method + " " + req.URL.String() + "\n")
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if secretHeader(name) {
+			value = "REDACTED"
+		}
+		s.WriteString(name + ": " + value + "\n")
+	}
+
+	body, err := json.MarshalIndent(reqBody, "", "  ")
+	if err != nil {
+		return "", false, fmt.Errorf("error marshaling request: %w", err)
+	}
+	s.WriteString("\n" + string(body))
+	return s.String(), last != nil, nil
+}
+
+// secretHeader reports whether a header probably holds a credential
+func secretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"key", "auth", "token", "secret", "cookie"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// Model returns the model requests are sent to
+func (c *Client) Model() string {
+	return c.model
+}
+
+// RateLimit returns the rate limit state from the most recent response
+func (c *Client) RateLimit() RateLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLimit
+}
+
+func parseRateLimit(header http.Header) RateLimit {
+	atoi := func(name string) int {
+		n, _ := strconv.Atoi(header.Get(name))
+		return n
+	}
+	parseTime := func(name string) time.Time {
+		t, _ := time.Parse(time.RFC3339, header.Get(name))
+		return t
+	}
+
+	return RateLimit{
+		RequestsLimit:     atoi("anthropic-ratelimit-requests-limit"),
+		RequestsRemaining: atoi("anthropic-ratelimit-requests-remaining"),
+		RequestsReset:     parseTime("anthropic-ratelimit-requests-reset"),
+		TokensLimit:       atoi("anthropic-ratelimit-tokens-limit"),
+		TokensRemaining:   atoi("anthropic-ratelimit-tokens-remaining"),
+		TokensReset:       parseTime("anthropic-ratelimit-tokens-reset"),
+	}
+}
+
+func (c *Client) CreateMessage(messages []Message) (string, error) {
+	resp, err := c.sendWithRetry(context.Background(), c.newRequest(messages, Params{}), nil)
+	if err != nil {
+		return "", err
 	}
 	defer resp.Body.Close()
 
@@ -89,7 +514,7 @@ func (c *Client) CreateMessage(messages []Message) (string, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
+		return "", newAPIError(resp.StatusCode, body)
 	}
 
 	var response CreateMessageResponse
@@ -97,9 +522,106 @@ func (c *Client) CreateMessage(messages []Message) (string, error) {
 		return "", fmt.Errorf("error unmarshaling response: %w", err)
 	}
 
-	if len(response.Content) == 0 {
-		return "", fmt.Errorf("no content in response")
+	// The response can be split over several blocks, only the text ones are
+	// meant for the user
+	var text strings.Builder
+	for _, block := range response.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	if text.Len() == 0 {
+		return "", &EmptyResponseError{StopReason: response.StopReason}
+	}
+
+	return text.String(), nil
+}
+
+// StreamMessage sends messages like CreateMessage but streams the response
+// to handler as it arrives. If the stream is cut off, the response received
+// so far is returned along with ErrStreamInterrupted.
+//
+// When the last message is from the assistant, the model continues that
+// message instead of starting a new one. params override the client's
+// settings for this response.
+func (c *Client) StreamMessage(ctx context.Context, messages []Message, params Params, handler StreamHandler) (Response, error) {
+	reqBody := c.newRequest(messages, params)
+	reqBody.Stream = true
+
+	var response Response
+	resp, err := c.sendWithRetry(ctx, reqBody, handler.OnRetry)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return response, fmt.Errorf("error reading response body: %w", err)
+		}
+		return response, newAPIError(resp.StatusCode, body)
 	}
 
-	return response.Content[0].Text, nil
+	var text, thinking strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event streamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			response.Text = text.String()
+			response.Thinking = thinking.String()
+			return response, fmt.Errorf("error unmarshaling stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			response.Usage = event.Message.Usage
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				text.WriteString(event.Delta.Text)
+				if handler.OnText != nil {
+					handler.OnText(event.Delta.Text)
+				}
+			case "thinking_delta":
+				thinking.WriteString(event.Delta.Thinking)
+				if handler.OnThinking != nil {
+					handler.OnThinking(event.Delta.Thinking)
+				}
+			}
+		case "message_delta":
+			response.StopReason = event.Delta.StopReason
+			response.Usage.OutputTokens = event.Usage.OutputTokens
+		case "message_stop":
+			response.Text = text.String()
+			response.Thinking = thinking.String()
+			if response.Text == "" {
+				return response, &EmptyResponseError{StopReason: response.StopReason}
+			}
+			return response, nil
+		case "error":
+			response.Text = text.String()
+			response.Thinking = thinking.String()
+			return response, &APIError{Type: event.Error.Type, Message: event.Error.Message}
+		}
+	}
+
+	response.Text = text.String()
+	response.Thinking = thinking.String()
+	// Reading fails when the caller gives up on the response, which isn't the
+	// connection dropping
+	if err := ctx.Err(); err != nil {
+		return response, err
+	}
+	if err := scanner.Err(); err != nil {
+		return response, fmt.Errorf("%w: %v", ErrStreamInterrupted, err)
+	}
+	return response, ErrStreamInterrupted
 }
@@ -0,0 +1,205 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestClient returns a client that sends its requests to handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewClient(
+		WithAPIKey("test-key"),
+		WithBaseURL(server.URL),
+		WithHTTPClient(server.Client()),
+	)
+}
+
+func TestCreateMessage(t *testing.T) {
+	var got CreateMessageRequest
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("x-api-key"); key != "test-key" {
+			t.Errorf("x-api-key = %q, want %q", key, "test-key")
+		}
+		if version := r.Header.Get("anthropic-version"); version != DefaultAPIVersion {
+			t.Errorf("anthropic-version = %q, want %q", version, DefaultAPIVersion)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		fmt.Fprint(w, `{"role":"assistant","content":[{"type":"text","text":"Hello!"}],"stop_reason":"end_turn"}`)
+	})
+
+	text, err := client.CreateMessage([]Message{
+		{Role: "system", Content: "Be brief"},
+		{Role: "user", Content: "Hi"},
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if text != "Hello!" {
+		t.Errorf("text = %q, want %q", text, "Hello!")
+	}
+	if got.System != "Be brief" {
+		t.Errorf("system = %q, want %q", got.System, "Be brief")
+	}
+	if len(got.Messages) != 1 || got.Messages[0].Role != "user" {
+		t.Errorf("messages = %+v, want only the user message", got.Messages)
+	}
+}
+
+func TestCreateMessageJoinsTextBlocks(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"role":"assistant","stop_reason":"tool_use","content":[
+			{"type":"thinking","thinking":"The user wants a listing."},
+			{"type":"text","text":"Here you go:\n"},
+			{"type":"tool_use","id":"toolu_1","name":"bash","input":{"command":"ls"}},
+			{"type":"text","text":"<command>ls -la</command>"}
+		]}`)
+	})
+
+	text, err := client.CreateMessage([]Message{{Role: "user", Content: "List files"}})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if want := "Here you go:\n<command>ls -la</command>"; text != want {
+		t.Errorf("text = %q, want %q", text, want)
+	}
+}
+
+func TestCreateMessageErrorBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want APIError
+	}{
+		{
+			name: "json",
+			body: `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens is too large"}}`,
+			want: APIError{StatusCode: 400, Type: "invalid_request_error", Message: "max_tokens is too large"},
+		},
+		{
+			name: "plain text",
+			body: "Bad Request",
+			want: APIError{StatusCode: 400, Message: "Bad Request"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, tt.body)
+			})
+
+			_, err := client.CreateMessage([]Message{{Role: "user", Content: "Hi"}})
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %v, want an *APIError", err)
+			}
+			if *apiErr != tt.want {
+				t.Errorf("err = %+v, want %+v", *apiErr, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateMessageRetries(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, 529} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			t.Parallel()
+			var attempts atomic.Int32
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) == 1 {
+					w.Header().Set("retry-after", "1")
+					w.WriteHeader(status)
+					return
+				}
+				fmt.Fprint(w, `{"content":[{"type":"text","text":"ok"}]}`)
+			})
+
+			text, err := client.CreateMessage([]Message{{Role: "user", Content: "Hi"}})
+			if err != nil {
+				t.Fatalf("CreateMessage: %v", err)
+			}
+			if text != "ok" {
+				t.Errorf("text = %q, want %q", text, "ok")
+			}
+			if n := attempts.Load(); n != 2 {
+				t.Errorf("attempts = %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestStreamMessage(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var req CreateMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		if !req.Stream {
+			t.Error("stream = false, want true")
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, strings.Join([]string{
+			"event: message_start",
+			`data: {"type":"message_start","message":{"usage":{"input_tokens":12,"output_tokens":1}}}`,
+			"",
+			"event: content_block_delta",
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+			"",
+			"event: ping",
+			`data: {"type":"ping"}`,
+			"",
+			"event: content_block_delta",
+			`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}`,
+			"",
+			"event: message_delta",
+			`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+			"",
+			"event: message_stop",
+			`data: {"type":"message_stop"}`,
+			"",
+		}, "\n"))
+	})
+
+	var chunks []string
+	response, err := client.StreamMessage(context.Background(), []Message{{Role: "user", Content: "Hi"}}, Params{}, StreamHandler{
+		OnText: func(text string) { chunks = append(chunks, text) },
+	})
+	if err != nil {
+		t.Fatalf("StreamMessage: %v", err)
+	}
+	want := Response{Text: "Hello, world", StopReason: "end_turn", Usage: Usage{InputTokens: 12, OutputTokens: 5}}
+	if response != want {
+		t.Errorf("response = %+v, want %+v", response, want)
+	}
+	if len(chunks) != 2 {
+		t.Errorf("chunks = %q, want 2", chunks)
+	}
+}
+
+func TestStreamMessageInterrupted(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"Partial"}}`+"\n\n")
+	})
+
+	response, err := client.StreamMessage(context.Background(), []Message{{Role: "user", Content: "Hi"}}, Params{}, StreamHandler{})
+	if !errors.Is(err, ErrStreamInterrupted) {
+		t.Fatalf("err = %v, want ErrStreamInterrupted", err)
+	}
+	if response.Text != "Partial" {
+		t.Errorf("text = %q, want %q", response.Text, "Partial")
+	}
+}
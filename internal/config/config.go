@@ -0,0 +1,451 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gpt-term/internal/appdir"
+	"gpt-term/internal/persona"
+)
+
+type Config struct {
+	// APIKey is used when CLAUDE_API_KEY isn't set
+	APIKey string `json:"api_key,omitempty"`
+	// Model overrides the default Claude model
+	Model string `json:"model,omitempty"`
+	// FallbackModel is offered to retry a request with when it fails with the
+	// main model
+	FallbackModel string `json:"fallback_model,omitempty"`
+	// BaseURL sends requests to a gateway or proxy instead of the Anthropic API
+	BaseURL string `json:"base_url,omitempty"`
+	// Headers are added to every request, e.g. the auth a gateway needs
+	Headers map[string]string `json:"headers,omitempty"`
+	// APIVersion is sent as the anthropic-version header, e.g. to opt into
+	// a newer API version. Empty sends claude.DefaultAPIVersion.
+	APIVersion string `json:"api_version,omitempty"`
+	// Persona is the built-in persona new chats start with, see
+	// persona.Builtin. Empty means the shell helper.
+	Persona string `json:"persona,omitempty"`
+	// Editor is used to edit messages, before $EDITOR
+	Editor string `json:"editor,omitempty"`
+
+	Sandbox SandboxConfig `json:"sandbox"`
+	// StripANSI removes color codes and other terminal escapes from command
+	// output before it's stored, since they garble the rendered message
+	StripANSI bool `json:"strip_ansi"`
+	// MaxOutputMB caps how much output a command can produce before it's
+	// killed, so something like `yes` can't use up all memory. 0 means no limit.
+	MaxOutputMB int `json:"max_output_mb"`
+	// CommandEnv adds environment variables to the commands gpt-term runs,
+	// e.g. ENV=dev. $VAR in values is expanded, so PATH can be extended.
+	CommandEnv map[string]string `json:"command_env,omitempty"`
+	// LiveFeedSeconds lets L in the command selection run a command whose
+	// output is sent to the model this often while it runs. 0 turns it off.
+	LiveFeedSeconds int `json:"live_feed_seconds"`
+	// WrapLists makes up/down in the history and command lists wrap around
+	// from one end to the other
+	WrapLists bool `json:"wrap_lists"`
+	// ContextMessages caps how many of the most recent messages are sent with
+	// each request to keep long conversations cheap. 0 sends them all.
+	ContextMessages int `json:"context_messages"`
+	// ThinkingBudget turns on extended thinking for models that support it,
+	// letting the model spend this many tokens reasoning before it answers.
+	// 0 turns it off, otherwise it must be at least 1024.
+	ThinkingBudget int `json:"thinking_budget"`
+	// MaxTokens caps the length of responses. 0 keeps the client's default.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// ModelMaxTokens overrides MaxTokens for some models, and
+	// PersonaMaxTokens for some personas, which win over both
+	ModelMaxTokens   map[string]int `json:"model_max_tokens,omitempty"`
+	PersonaMaxTokens map[string]int `json:"persona_max_tokens,omitempty"`
+	// ShellHistory is how many recent shell commands Alt+H attaches to the
+	// next prompt. It's 0, turning the key off, unless the user opts in since
+	// history can hold secrets.
+	ShellHistory int `json:"shell_history"`
+	// AutoExecute lets Alt+X run the latest response's command right away
+	// when it's the only one and isn't on the denylist
+	AutoExecute bool `json:"auto_execute"`
+	// ExpansionWarnings shows what the variables in a command expand to in
+	// the confirmation, and makes auto-execute confirm commands using unset ones
+	ExpansionWarnings bool `json:"expansion_warnings"`
+	// InlineCommands also offers commands the model wrote as inline code in
+	// a list, like "1. Run `make build`", instead of tagging them
+	InlineCommands bool `json:"inline_commands"`
+	// ShowEnvironment lists the shell, working directory and privileges a
+	// command will run with in the confirmation overlay
+	ShowEnvironment bool `json:"show_environment"`
+	// AutoScroll scrolls down to new responses and command output as they
+	// arrive. Alt+A toggles it.
+	AutoScroll bool `json:"auto_scroll"`
+	// ConfirmSend makes Enter show the prompt as it'll be sent first, and
+	// only send it on a second Enter
+	ConfirmSend bool `json:"confirm_send"`
+	// TrimMessages drops trailing whitespace and extra blank lines from
+	// prompts and edited messages, outside of code blocks
+	TrimMessages bool `json:"trim_messages"`
+	// Compact drops the scroll indicators and key hints and puts the input
+	// and status on one line, leaving more room on small terminals
+	Compact bool `json:"compact"`
+	// MinimalUI shows only the conversation and a bare input, without the
+	// title, scroll indicators and key hints, e.g. for screen recordings.
+	// Alt+U toggles it.
+	MinimalUI bool `json:"minimal_ui"`
+	// LineNumbers numbers the lines of code blocks and command output
+	LineNumbers bool `json:"line_numbers"`
+	// MessageTokens shows the tokens each response cost next to its label
+	MessageTokens bool `json:"message_tokens"`
+	// CollapseLines collapses responses longer than this many lines to their
+	// first few. E on one in edit mode expands it. 0 never collapses.
+	CollapseLines int `json:"collapse_lines"`
+	// TruncateCommands shows each command in the selection list on one line,
+	// cut off to fit, instead of wrapping it. W in the list toggles it.
+	TruncateCommands bool `json:"truncate_commands"`
+	// HistoryTimestamps is how the history list shows when conversations
+	// started, one of HistoryTimestampModes. T in the list cycles through them.
+	HistoryTimestamps string `json:"history_timestamps"`
+	// PipeCommand gets the open conversation on stdin when Alt+W is pressed,
+	// e.g. "pbcopy" or a notes app's CLI. It runs with sh -c, and {id} and
+	// {summary} in it are replaced with the conversation's, quoted.
+	PipeCommand string `json:"pipe_command,omitempty"`
+	// PipeFormat is what PipeCommand gets, "markdown" (the default) or "json"
+	PipeFormat string `json:"pipe_format,omitempty"`
+	// Macros bind a key, like "alt+1", to actions run one after another,
+	// see MacroActions
+	Macros map[string][]string `json:"macros,omitempty"`
+	// Denylist holds snippets that stop a command from being auto-executed
+	Denylist []string `json:"denylist"`
+	// Templates are presets offered when starting a new chat with Ctrl+N
+	Templates []Template `json:"templates,omitempty"`
+	// Theme overrides the colors of the conversation
+	Theme Theme `json:"theme"`
+}
+
+// Theme holds colors for each role's label and message text. Colors are ANSI
+// numbers from 0 to 255 or hex like "#ff8700". Unset ones keep the default.
+type Theme struct {
+	UserLabel          string `json:"user_label,omitempty"`
+	UserLabelText      string `json:"user_label_text,omitempty"`
+	UserText           string `json:"user_text,omitempty"`
+	AssistantLabel     string `json:"assistant_label,omitempty"`
+	AssistantLabelText string `json:"assistant_label_text,omitempty"`
+	AssistantText      string `json:"assistant_text,omitempty"`
+	SystemText         string `json:"system_text,omitempty"`
+}
+
+// headerNameRe matches the characters allowed in an HTTP header name
+var headerNameRe = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// validateHeaders checks that headers can be sent as they are
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !headerNameRe.MatchString(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %s can't contain line breaks", name)
+		}
+	}
+	return nil
+}
+
+// ValidateAPIVersion checks that version is a date like 2023-06-01, the
+// format of anthropic-version
+func ValidateAPIVersion(version string) error {
+	if _, err := time.Parse("2006-01-02", version); err != nil {
+		return fmt.Errorf("invalid API version %q, it should be a date like 2023-06-01", version)
+	}
+	return nil
+}
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnv checks that env only sets valid variable names
+func validateEnv(env map[string]string) error {
+	for name := range env {
+		if !envNameRe.MatchString(name) {
+			return fmt.Errorf("command_env: invalid variable name %q", name)
+		}
+	}
+	return nil
+}
+
+var colorRe = regexp.MustCompile(`^(#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|[0-9]{1,3})$`)
+
+// validate checks that every color set in the theme is one lipgloss accepts
+func (t Theme) validate() error {
+	colors := []struct{ name, value string }{
+		{"user_label", t.UserLabel},
+		{"user_label_text", t.UserLabelText},
+		{"user_text", t.UserText},
+		{"assistant_label", t.AssistantLabel},
+		{"assistant_label_text", t.AssistantLabelText},
+		{"assistant_text", t.AssistantText},
+		{"system_text", t.SystemText},
+	}
+	for _, c := range colors {
+		if c.value == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(c.value); !colorRe.MatchString(c.value) || (err == nil && n > 255) {
+			return fmt.Errorf("invalid color %q for theme.%s, use an ANSI number from 0 to 255 or hex like #ff8700", c.value, c.name)
+		}
+	}
+	return nil
+}
+
+// Template starts a conversation with its own system prompt and optionally
+// some messages already in it
+type Template struct {
+	Name         string `json:"name"`
+	SystemPrompt string `json:"system_prompt"`
+	// Persona uses a built-in persona's system prompt when SystemPrompt is
+	// empty
+	Persona  string            `json:"persona,omitempty"`
+	Messages []TemplateMessage `json:"messages,omitempty"`
+}
+
+// TemplateMessage is a message a template seeds a new conversation with
+type TemplateMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// SandboxConfig restricts which suggested commands can be run from the app
+type SandboxConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Allowlist []string `json:"allowlist"`
+}
+
+// DefaultAllowlist holds read-only commands that are safe to run in sandbox mode
+var DefaultAllowlist = []string{
+	"ls", "cat", "grep", "ps", "pwd", "head", "tail", "wc", "which",
+	"whoami", "df", "du", "date", "uname", "echo", "stat", "file",
+}
+
+// DefaultDenylist catches destructive commands that should always be confirmed
+var DefaultDenylist = []string{
+	"rm -r", "rm -f", "sudo", "mkfs", "dd if=", "shutdown", "reboot",
+	":(){", "> /dev/", "chmod -R", "chown -R", "git push --force", "git reset --hard",
+}
+
+func Default() *Config {
+	return &Config{
+		Sandbox: SandboxConfig{
+			Enabled:   false,
+			Allowlist: DefaultAllowlist,
+		},
+		StripANSI:         true,
+		MaxOutputMB:       10,
+		CollapseLines:     40,
+		AutoScroll:        true,
+		ExpansionWarnings: true,
+		TrimMessages:      true,
+		HistoryTimestamps: "full",
+		Denylist:          DefaultDenylist,
+	}
+}
+
+// HistoryTimestampModes are the values of history_timestamps: full date and
+// time, how long ago, or just the date
+var HistoryTimestampModes = []string{"full", "relative", "date"}
+
+// Path returns the location of the config file, ~/.gpt-term/config.json
+// unless appdir picks another directory
+func Path() (string, error) {
+	dir, _, err := appdir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// Exists reports whether a config file has been written
+func Exists() bool {
+	path, err := Path()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// Save writes cfg to the config file. The file is only readable by the user
+// since it can hold the API key.
+func Save(cfg *Config) error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling config: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing config file: %w", err)
+	}
+
+	return nil
+}
+
+// SaveSetting sets a single key of the config file to value, leaving the
+// rest of the file as it is so settings the user never changed keep following
+// the defaults
+func SaveSetting(key string, value any) error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[string]json.RawMessage)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("error marshaling %s: %w", key, err)
+	}
+	settings[key] = encoded
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating config directory: %w", err)
+	}
+	data, err = json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling config: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("error writing config file: %w", err)
+	}
+	return nil
+}
+
+// MacroActions are the actions a macro can run
+var MacroActions = []string{"send", "execute", "regenerate", "copy-output", "follow-up"}
+
+// validateMacros checks that macros only use known actions
+func validateMacros(macros map[string][]string) error {
+	for key, actions := range macros {
+		if len(actions) == 0 {
+			return fmt.Errorf("macro %q has no actions", key)
+		}
+		for _, action := range actions {
+			known := false
+			for _, name := range MacroActions {
+				known = known || action == name
+			}
+			if !known {
+				return fmt.Errorf("macro %q: unknown action %q, use one of: %s", key, action, strings.Join(MacroActions, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// MaxTokensFor returns the max_tokens for responses from model in a
+// conversation with a persona: the persona's setting, then the model's, then
+// MaxTokens. 0 leaves it to the client.
+func (c *Config) MaxTokensFor(model, personaName string) int {
+	if personaName == "" {
+		personaName = persona.Default
+	}
+	for name, maxTokens := range c.PersonaMaxTokens {
+		if strings.EqualFold(name, personaName) && maxTokens > 0 {
+			return maxTokens
+		}
+	}
+	if maxTokens := c.ModelMaxTokens[model]; maxTokens > 0 {
+		return maxTokens
+	}
+	return c.MaxTokens
+}
+
+// ValidatePersona checks that name is a built-in persona, or empty
+func ValidatePersona(name string) error {
+	if _, ok := persona.Find(name); name != "" && !ok {
+		return fmt.Errorf("unknown persona %q, use one of: %s", name, persona.Names())
+	}
+	return nil
+}
+
+// Load reads the config file, falling back to the defaults for anything it
+// doesn't set. A missing file is not an error.
+func Load() (*Config, error) {
+	cfg := Default()
+
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+
+	if err := cfg.Theme.validate(); err != nil {
+		return nil, fmt.Errorf("error in config file %s: %w", path, err)
+	}
+	if err := validateHeaders(cfg.Headers); err != nil {
+		return nil, fmt.Errorf("error in config file %s: %w", path, err)
+	}
+	if err := validateEnv(cfg.CommandEnv); err != nil {
+		return nil, fmt.Errorf("error in config file %s: %w", path, err)
+	}
+	if cfg.APIVersion != "" {
+		if err := ValidateAPIVersion(cfg.APIVersion); err != nil {
+			return nil, fmt.Errorf("error in config file %s: %w", path, err)
+		}
+	}
+	if err := ValidatePersona(cfg.Persona); err != nil {
+		return nil, fmt.Errorf("error in config file %s: %w", path, err)
+	}
+	if err := validateMacros(cfg.Macros); err != nil {
+		return nil, fmt.Errorf("error in config file %s: %w", path, err)
+	}
+	if cfg.PipeFormat != "" && cfg.PipeFormat != "markdown" && cfg.PipeFormat != "json" {
+		return nil, fmt.Errorf("error in config file %s: unknown pipe_format %q, use markdown or json", path, cfg.PipeFormat)
+	}
+	if !slices.Contains(HistoryTimestampModes, cfg.HistoryTimestamps) {
+		return nil, fmt.Errorf("error in config file %s: unknown history_timestamps %q, use one of: %s", path, cfg.HistoryTimestamps, strings.Join(HistoryTimestampModes, ", "))
+	}
+	for name := range cfg.PersonaMaxTokens {
+		if err := ValidatePersona(name); err != nil {
+			return nil, fmt.Errorf("error in config file %s: persona_max_tokens: %w", path, err)
+		}
+	}
+	for _, tmpl := range cfg.Templates {
+		if err := ValidatePersona(tmpl.Persona); err != nil {
+			return nil, fmt.Errorf("error in config file %s: template %q: %w", path, tmpl.Name, err)
+		}
+	}
+
+	return cfg, nil
+}
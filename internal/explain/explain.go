@@ -0,0 +1,103 @@
+package explain
+
+import (
+	"regexp"
+	"strings"
+)
+
+// programs describes common shell programs in a few words
+var programs = map[string]string{
+	"awk":     "process text by fields",
+	"cat":     "print file contents",
+	"cd":      "change directory",
+	"chmod":   "change file permissions",
+	"chown":   "change file owner",
+	"cp":      "copy files",
+	"curl":    "transfer data from a URL",
+	"cut":     "extract columns from lines",
+	"date":    "print the date and time",
+	"df":      "show free disk space",
+	"docker":  "manage containers",
+	"du":      "show disk usage of files",
+	"echo":    "print text",
+	"env":     "print or set environment variables",
+	"find":    "search for files",
+	"git":     "version control",
+	"grep":    "search text for a pattern",
+	"gzip":    "compress files",
+	"head":    "print the first lines",
+	"kill":    "send a signal to a process",
+	"ln":      "create links",
+	"ls":      "list directory contents",
+	"lsof":    "list open files",
+	"mkdir":   "create directories",
+	"mv":      "move or rename files",
+	"npm":     "manage Node.js packages",
+	"ps":      "list processes",
+	"pwd":     "print the current directory",
+	"rm":      "DELETE files",
+	"rmdir":   "delete empty directories",
+	"rsync":   "sync files",
+	"sed":     "edit text with patterns",
+	"sort":    "sort lines",
+	"ssh":     "log into a remote machine",
+	"stat":    "show file details",
+	"sudo":    "run as root",
+	"tail":    "print the last lines",
+	"tar":     "create or extract archives",
+	"tee":     "copy input to files",
+	"touch":   "create or update files",
+	"tr":      "translate characters",
+	"uniq":    "drop repeated lines",
+	"unzip":   "extract zip archives",
+	"wc":      "count lines, words and bytes",
+	"wget":    "download files",
+	"which":   "locate a program",
+	"whoami":  "print the current user",
+	"xargs":   "build commands from input",
+	"zip":     "create zip archives",
+	"apt":     "manage Debian packages",
+	"apt-get": "manage Debian packages",
+	"brew":    "manage Homebrew packages",
+	"pip":     "manage Python packages",
+	"go":      "Go toolchain",
+	"make":    "run build targets",
+}
+
+// Local explains cmd from the programs it runs, one line per pipeline or list
+// step, e.g. "find: search for files". It returns false if any program isn't
+// known, so a better explanation can be asked for instead.
+func Local(cmd string) (string, bool) {
+	splitRe := regexp.MustCompile(`\|\||&&|[|;&\n]`)
+	var lines []string
+	for _, part := range splitRe.Split(cmd, -1) {
+		fields := strings.Fields(part)
+		// Skip leading variable assignments like FOO=bar
+		for len(fields) > 0 && strings.Contains(fields[0], "=") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		desc, ok := programs[fields[0]]
+		if !ok {
+			return "", false
+		}
+		lines = append(lines, fields[0]+": "+desc)
+	}
+	if len(lines) == 0 {
+		return "", false
+	}
+	return strings.Join(lines, "\n"), true
+}
+
+// OutputPrompt asks the model to interpret the output of cmd, which is already
+// in the conversation
+func OutputPrompt(cmd string) string {
+	return "Explain the output of `" + cmd + "` above and tell me if anything in it is wrong, like failed tests or errors, and how to fix it."
+}
+
+// Prompt asks the model for a short explanation of cmd
+func Prompt(cmd string) string {
+	return "Explain in one or two short sentences, without using <command> tags, what this shell command does and whether it changes anything:\n\n" + cmd
+}
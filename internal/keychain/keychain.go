@@ -0,0 +1,74 @@
+package keychain
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	service = "gpt-term"
+	account = "api-key"
+)
+
+// Get reads the API key from the OS keychain: the macOS Keychain, the Secret
+// Service on Linux (through secret-tool) or the Windows Credential Manager
+func Get() (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	case "windows":
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", windowsVault+
+			"$c = $vault.Retrieve('"+service+"', '"+account+"'); $c.RetrievePassword(); $c.Password")
+	default:
+		return "", fmt.Errorf("unsupported platform for keychain access")
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error reading API key from keychain: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Set stores the API key in the OS keychain, replacing any previous one
+func Set(apiKey string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// security's interactive mode reads the command from stdin, which keeps
+		// the key out of the process list
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+			service, account, securityQuote(apiKey)))
+	case "linux":
+		cmd = exec.Command("secret-tool", "store", "--label=gpt-term API key", "service", service, "account", account)
+		cmd.Stdin = strings.NewReader(apiKey)
+	case "windows":
+		// Pass the key on stdin so it doesn't show up in the process list
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", windowsVault+
+			"$key = [Console]::In.ReadLine(); "+
+			"$vault.Add((New-Object Windows.Security.Credentials.PasswordCredential('"+service+"', '"+account+"', $key)))")
+		cmd.Stdin = strings.NewReader(apiKey + "\n")
+	default:
+		return fmt.Errorf("unsupported platform for keychain access")
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error storing API key in keychain: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// securityQuote quotes s as a single argument for security's interactive mode
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// windowsVault loads the Credential Manager API into $vault
+const windowsVault = "[void][Windows.Security.Credentials.PasswordVault,Windows.Security.Credentials,ContentType=WindowsRuntime]; " +
+	"$vault = New-Object Windows.Security.Credentials.PasswordVault; "
@@ -0,0 +1,112 @@
+package livecmd
+
+import (
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"gpt-term/internal/procgroup"
+)
+
+// Command is a shell command running in the background whose output can be
+// read while it runs
+type Command struct {
+	Text string
+
+	cmd  *exec.Cmd
+	mu   sync.Mutex
+	out  []byte
+	read int // How much of out Next has handed out
+	done bool
+	err  error
+}
+
+// Start runs cmdStr in dir with shell, a program and its flags such as
+// "sh", "-c", with env as its environment or gpt-term's if nil. Output past
+// maxBytes kills the command, 0 means no limit.
+func Start(shell []string, cmdStr, dir string, env []string, maxBytes int) (*Command, error) {
+	c := &Command{Text: cmdStr, cmd: exec.Command(shell[0], append(shell[1:len(shell):len(shell)], cmdStr)...)}
+	c.cmd.Dir = dir
+	c.cmd.Env = env
+	w := &writer{c: c, limit: maxBytes}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = w
+	// Stopping it kills everything it started, not just the shell
+	procgroup.Set(c.cmd)
+	// Don't wait for children of the killed shell that still hold the pipe
+	c.cmd.WaitDelay = time.Second
+	if err := c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting command: %w", err)
+	}
+
+	go func() {
+		err := c.cmd.Wait()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.done = true
+		if c.err == nil {
+			c.err = err
+		}
+	}()
+	return c, nil
+}
+
+// Next returns the output that arrived since the last call, keeping only its
+// last max bytes, and how many bytes were dropped to fit. done and err say
+// whether the command has finished and how.
+func (c *Command) Next(max int) (output string, skipped int, done bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunk := c.out[c.read:]
+	c.read = len(c.out)
+	if max > 0 && len(chunk) > max {
+		skipped = len(chunk) - max
+		chunk = chunk[skipped:]
+	}
+	return string(chunk), skipped, c.done, c.err
+}
+
+// Pending reports whether there's output Next hasn't returned yet, or the
+// command finished since
+func (c *Command) Pending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read < len(c.out)
+}
+
+// Done reports whether the command has finished
+func (c *Command) Done() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// Stop kills the command, and the processes it started, if it's still running
+func (c *Command) Stop() {
+	if !c.Done() {
+		procgroup.Kill(c.cmd)
+	}
+}
+
+// writer appends to the command's output up to limit bytes. Past that it
+// kills the command and throws the rest away.
+type writer struct {
+	c     *Command
+	limit int
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	if w.limit > 0 && len(w.c.out)+len(p) > w.limit {
+		w.c.out = append(w.c.out, p[:w.limit-len(w.c.out)]...)
+		if w.c.err == nil {
+			w.c.err = fmt.Errorf("output over %d bytes, command killed", w.limit)
+			procgroup.Kill(w.c.cmd)
+		}
+		return len(p), nil
+	}
+	w.c.out = append(w.c.out, p...)
+	return len(p), nil
+}
@@ -0,0 +1,142 @@
+package pager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// Pager adds less-like keys to a viewport showing a long text: j/k and the
+// arrows scroll a line, Ctrl+D/Ctrl+U half a page, g and G go to the top and
+// bottom, a line number followed by g or Enter jumps to that line, and n/N go
+// between the matches of a search
+type Pager struct {
+	lines   []string // The content without styling, for searching
+	query   string
+	matches []int // Lines matching query
+	current int   // Index into matches of the one last jumped to
+	count   string
+}
+
+// SetContent shows content in vp from the top, dropping the last search
+func (p *Pager) SetContent(vp *viewport.Model, content string) {
+	*p = Pager{lines: strings.Split(ansi.Strip(content), "\n")}
+	vp.SetContent(content)
+	vp.GotoTop()
+}
+
+// Refresh shows new content in vp without moving, e.g. after a resize, and
+// searches it again
+func (p *Pager) Refresh(vp *viewport.Model, content string) {
+	offset := vp.YOffset
+	p.lines = strings.Split(ansi.Strip(content), "\n")
+	p.matches = p.find(p.query)
+	p.current = min(p.current, max(0, len(p.matches)-1))
+	vp.SetContent(content)
+	vp.SetYOffset(offset)
+}
+
+// Search jumps to the first line after the top of vp containing query,
+// ignoring case, and reports whether there was one
+func (p *Pager) Search(vp *viewport.Model, query string) bool {
+	p.query = query
+	p.matches = p.find(query)
+	if len(p.matches) == 0 {
+		return false
+	}
+	p.current = 0
+	for i, line := range p.matches {
+		if line > vp.YOffset {
+			p.current = i
+			break
+		}
+	}
+	vp.SetYOffset(p.matches[p.current])
+	return true
+}
+
+func (p *Pager) find(query string) []int {
+	if query == "" {
+		return nil
+	}
+	query = strings.ToLower(query)
+	var matches []int
+	for i, line := range p.lines {
+		if strings.Contains(strings.ToLower(line), query) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// Update handles key, as returned by tea.KeyMsg.String, and reports whether
+// it was a pager key
+func (p *Pager) Update(vp *viewport.Model, key string) bool {
+	// Digits add up to a line number for g or Enter
+	if len(key) == 1 && key[0] >= '0' && key[0] <= '9' {
+		p.count += key
+		return true
+	}
+	count := p.count
+	p.count = ""
+
+	switch key {
+	case "up", "k":
+		vp.LineUp(1)
+	case "down", "j":
+		vp.LineDown(1)
+	case "pgup", "b":
+		vp.ViewUp()
+	case "pgdown", " ", "f":
+		vp.ViewDown()
+	case "ctrl+u":
+		vp.HalfViewUp()
+	case "ctrl+d":
+		vp.HalfViewDown()
+	case "home", "g", "enter":
+		if n, err := strconv.Atoi(count); err == nil {
+			vp.SetYOffset(n - 1)
+		} else if key != "enter" {
+			vp.GotoTop()
+		}
+	case "end", "G":
+		if n, err := strconv.Atoi(count); err == nil {
+			vp.SetYOffset(n - 1)
+		} else {
+			vp.GotoBottom()
+		}
+	case "n", "N":
+		if len(p.matches) == 0 {
+			return true
+		}
+		step := 1
+		if key == "N" {
+			step = len(p.matches) - 1
+		}
+		p.current = (p.current + step) % len(p.matches)
+		vp.SetYOffset(p.matches[p.current])
+	default:
+		return false
+	}
+	return true
+}
+
+// Status says where vp is and how the search went, e.g.
+// "lines 1-20 of 64 · match 2/5 for "proxy""
+func (p *Pager) Status(vp *viewport.Model) string {
+	total := vp.TotalLineCount()
+	last := min(total, vp.YOffset+vp.Height)
+	status := fmt.Sprintf("lines %d-%d of %d", min(vp.YOffset+1, last), last, total)
+	switch {
+	case p.count != "":
+		status += " · go to line " + p.count
+	case p.query != "" && len(p.matches) == 0:
+		status += fmt.Sprintf(" · no match for %q", p.query)
+	case p.query != "":
+		status += fmt.Sprintf(" · match %d/%d for %q", p.current+1, len(p.matches), p.query)
+	}
+	return status
+}
@@ -0,0 +1,65 @@
+package persona
+
+import "strings"
+
+// Persona is a built-in system prompt for a kind of help
+type Persona struct {
+	Name        string // Used with --persona and in the config
+	Description string
+	// SystemPrompt is empty for the default shell helper, whose prompt lives
+	// with the rest of the app
+	SystemPrompt string
+	// Shell is the program and flags the persona's commands are run with,
+	// the command itself going last. Nil runs them with "sh -c".
+	Shell []string
+}
+
+// Default is the persona new chats use unless another is picked
+const Default = "bash"
+
+// Builtin lists the personas that ship with gpt-term, the default first
+var Builtin = []Persona{
+	{
+		Name:        Default,
+		Description: "Shell helper",
+	},
+	{
+		Name:        "powershell",
+		Description: "PowerShell helper",
+		SystemPrompt: "You are a PowerShell terminal helper AI. Unless the user asks otherwise, give all solutions as PowerShell commands, ideally one-liners when the task is simple. " +
+			"Surround each command with <command></command> tags. Each <command> block must contain exactly one command - if you need to show multiple commands, use multiple <command> blocks. " +
+			"Prefer full cmdlet names over aliases so the commands are easy to read.",
+		Shell: []string{"pwsh", "-NoProfile", "-Command"},
+	},
+	{
+		Name:        "coding",
+		Description: "Coding assistant",
+		SystemPrompt: "You are a senior software engineer helping in a terminal. Answer with working code in fenced code blocks, naming the language, and keep explanations short. " +
+			"Point out bugs and edge cases you notice. When a shell command helps, e.g. to run tests or install a dependency, surround it with <command></command> tags, one command per block.",
+	},
+	{
+		Name:        "eli5",
+		Description: "Explain like I'm five",
+		SystemPrompt: "You explain technical topics, commands and errors in plain words a beginner can follow. Use short sentences, everyday analogies and no jargon without explaining it. " +
+			"If you suggest a shell command, surround it with <command></command> tags, one command per block, and say what it does before it.",
+	},
+}
+
+// Find returns the built-in persona called name, ignoring case
+func Find(name string) (Persona, bool) {
+	for _, p := range Builtin {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return Persona{}, false
+}
+
+// Names lists the built-in personas, e.g. for an error message
+func Names() string {
+	names := make([]string, len(Builtin))
+	for i, p := range Builtin {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
+}
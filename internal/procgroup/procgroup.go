@@ -0,0 +1,20 @@
+//go:build !windows
+
+// Package procgroup runs a command in a process group of its own, so killing
+// it also kills the pipelines and background jobs it started
+package procgroup
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Set makes cmd start in a new process group. Call it before cmd.Start.
+func Set(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill kills the process group of cmd, started with Set
+func Kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,11 @@
+package procgroup
+
+import "os/exec"
+
+// Set does nothing on Windows, where there are no process groups to kill
+func Set(cmd *exec.Cmd) {}
+
+// Kill kills cmd itself on Windows
+func Kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,103 @@
+package shellhistory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// File returns the history file of the user's shell: $HISTFILE if set,
+// otherwise the most recently written of the usual zsh, bash and fish files
+func File() (string, error) {
+	if histFile := os.Getenv("HISTFILE"); histFile != "" {
+		return histFile, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting home directory: %w", err)
+	}
+
+	var newest string
+	var newestInfo os.FileInfo
+	for _, name := range []string{".zsh_history", ".bash_history", ".local/share/fish/fish_history"} {
+		path := filepath.Join(homeDir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if newestInfo == nil || info.ModTime().After(newestInfo.ModTime()) {
+			newest, newestInfo = path, info
+		}
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no shell history file found, set HISTFILE")
+	}
+	return newest, nil
+}
+
+// Recent returns the last n commands from the shell history, oldest first
+func Recent(n int) ([]string, error) {
+	path, err := File()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading shell history: %w", err)
+	}
+
+	var commands []string
+	if strings.HasSuffix(path, "fish_history") {
+		commands = parseFish(string(data))
+	} else {
+		commands = parse(string(data))
+	}
+
+	if len(commands) > n {
+		commands = commands[len(commands)-n:]
+	}
+	return commands, nil
+}
+
+// parse reads bash and zsh history. zsh's extended format prefixes each entry
+// with ": <timestamp>:<duration>;" and continues multi-line commands with a
+// trailing backslash.
+func parse(data string) []string {
+	extendedRe := regexp.MustCompile(`^: \d+:\d+;`)
+	timestampRe := regexp.MustCompile(`^#\d+$`)
+
+	var commands []string
+	var current strings.Builder
+	for _, line := range strings.Split(data, "\n") {
+		// bash writes timestamps as their own "#<seconds>" lines
+		if current.Len() == 0 && timestampRe.MatchString(line) {
+			continue
+		}
+		line = extendedRe.ReplaceAllString(line, "")
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\") + "\n")
+			continue
+		}
+		current.WriteString(line)
+		if cmd := strings.TrimSpace(current.String()); cmd != "" {
+			commands = append(commands, cmd)
+		}
+		current.Reset()
+	}
+	return commands
+}
+
+// parseFish reads fish history, where each entry is a "- cmd: " line
+func parseFish(data string) []string {
+	var commands []string
+	for _, line := range strings.Split(data, "\n") {
+		if cmd, ok := strings.CutPrefix(line, "- cmd: "); ok {
+			commands = append(commands, strings.ReplaceAll(cmd, `\n`, "\n"))
+		}
+	}
+	return commands
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The index maps conversation IDs to their files, so one can be loaded
+// without reading every conversation. It's only a shortcut: when it's missing
+// or wrong the files are scanned and it's rebuilt.
+
+// IndexReport sums up a rebuild of the index
+type IndexReport struct {
+	Indexed int
+	Failed  []IndexFailure // Files that couldn't be read and were left out
+}
+
+// IndexFailure is a conversation file that couldn't be indexed
+type IndexFailure struct {
+	File string
+	Err  error
+}
+
+func (s *Storage) indexPath() string {
+	return filepath.Join(filepath.Dir(s.baseDir), "index.json")
+}
+
+func (s *Storage) readIndex() (map[string]string, error) {
+	data, err := os.ReadFile(s.indexPath())
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	var index map[string]string
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("error parsing index: %w", err)
+	}
+	return index, nil
+}
+
+func (s *Storage) writeIndex(index map[string]string) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error marshaling index: %w", err)
+	}
+	if err := os.WriteFile(s.indexPath(), data, 0644); err != nil {
+		return fmt.Errorf("error writing index: %w", err)
+	}
+	return nil
+}
+
+// indexFile records that the conversation with id is stored in filename
+func (s *Storage) indexFile(id, filename string) error {
+	index, err := s.readIndex()
+	if err != nil {
+		// Start over from the files rather than drop everyone else's entries
+		_, err := s.RebuildIndex()
+		return err
+	}
+	if index[id] == filename {
+		return nil
+	}
+	index[id] = filename
+	return s.writeIndex(index)
+}
+
+// RebuildIndex indexes every conversation file again. Files that can't be
+// read or parsed, e.g. ones cut off by a crash, are skipped and reported
+// instead of failing the whole rebuild.
+func (s *Storage) RebuildIndex() (IndexReport, error) {
+	var report IndexReport
+	files, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return report, fmt.Errorf("error reading directory: %w", err)
+	}
+
+	index := make(map[string]string)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".convo" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.baseDir, file.Name()))
+		if err != nil {
+			report.Failed = append(report.Failed, IndexFailure{File: file.Name(), Err: err})
+			continue
+		}
+		var conv Conversation
+		if err := json.Unmarshal(data, &conv); err != nil {
+			report.Failed = append(report.Failed, IndexFailure{File: file.Name(), Err: err})
+			continue
+		}
+		if conv.ID == "" {
+			report.Failed = append(report.Failed, IndexFailure{File: file.Name(), Err: fmt.Errorf("no conversation ID")})
+			continue
+		}
+		index[conv.ID] = file.Name()
+		report.Indexed++
+	}
+
+	return report, s.writeIndex(index)
+}
+
+// loadIndexed loads the conversation with id using the index
+func (s *Storage) loadIndexed(id string) (*Conversation, bool) {
+	index, err := s.readIndex()
+	if err != nil || index[id] == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(s.baseDir, index[id]))
+	if err != nil {
+		return nil, false
+	}
+	conv, err := parseConversation(data)
+	if err != nil || conv.ID != id {
+		return nil, false
+	}
+	return &conv, true
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Recovery files hold the in-memory state of a running gpt-term, one per
+// process, so a session that was killed can be picked up again. A clean exit
+// removes its file.
+
+func (s *Storage) recoveryDir() string {
+	return filepath.Join(filepath.Dir(s.baseDir), "recovery")
+}
+
+func (s *Storage) recoveryPath(pid int) string {
+	return filepath.Join(s.recoveryDir(), strconv.Itoa(pid)+".json")
+}
+
+// SaveRecovery writes the conversations of this process to its recovery file
+func (s *Storage) SaveRecovery(convs []Conversation) error {
+	if err := os.MkdirAll(s.recoveryDir(), 0755); err != nil {
+		return fmt.Errorf("error creating recovery directory: %w", err)
+	}
+	data, err := json.Marshal(convs)
+	if err != nil {
+		return fmt.Errorf("error marshaling recovery state: %w", err)
+	}
+	if err := os.WriteFile(s.recoveryPath(os.Getpid()), data, 0600); err != nil {
+		return fmt.Errorf("error writing recovery file: %w", err)
+	}
+	return nil
+}
+
+// ClearRecovery removes this process's recovery file on a clean exit
+func (s *Storage) ClearRecovery() error {
+	return s.DiscardRecovery(s.recoveryPath(os.Getpid()))
+}
+
+// DiscardRecovery removes a recovery file returned by FindRecovery
+func (s *Storage) DiscardRecovery(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing recovery file: %w", err)
+	}
+	return nil
+}
+
+// FindRecovery looks for the recovery file of a gpt-term that didn't exit
+// cleanly and returns its path and conversations
+func (s *Storage) FindRecovery() (string, []Conversation, bool) {
+	files, err := os.ReadDir(s.recoveryDir())
+	if err != nil {
+		return "", nil, false
+	}
+
+	for _, file := range files {
+		pid, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+
+		path := filepath.Join(s.recoveryDir(), file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var convs []Conversation
+		if err := json.Unmarshal(data, &convs); err != nil || len(convs) == 0 {
+			// Nothing usable in it
+			os.Remove(path)
+			continue
+		}
+		return path, convs, true
+	}
+	return "", nil, false
+}
+
+// processAlive reports whether a process with pid is still running, so the
+// recovery file of another open gpt-term isn't mistaken for a crashed one
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// FindProcess only succeeds for running processes on Windows, elsewhere
+	// signal 0 checks without affecting the process
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
@@ -1,24 +1,87 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"gpt-term/internal/appdir"
+
+	"github.com/google/uuid"
 )
 
 type Message struct {
 	Role      string    `json:"role"`
 	Content   string    `json:"content"`
+	Thinking  string    `json:"thinking,omitempty"` // The model's reasoning before answering
 	Timestamp time.Time `json:"timestamp"`
+	// Truncated says why a response is incomplete, so it can be continued
+	Truncated string `json:"truncated,omitempty"`
+	// Flagged marks the message as important, so it can be found again
+	Flagged bool `json:"flagged,omitempty"`
+	// InputTokens and OutputTokens are what a response cost as reported by
+	// the API, zero for older messages and command output
+	InputTokens  int `json:"input_tokens,omitempty"`
+	OutputTokens int `json:"output_tokens,omitempty"`
 }
 
 type Conversation struct {
-	ID        string    `json:"id"`
-	Messages  []Message `json:"messages"`
-	CreatedAt time.Time `json:"created_at"`
-	Summary   string    `json:"summary"`
+	ID           string    `json:"id"`
+	Messages     []Message `json:"messages"`
+	CreatedAt    time.Time `json:"created_at"`
+	Summary      string    `json:"summary"`
+	InputTokens  int       `json:"input_tokens,omitempty"`
+	OutputTokens int       `json:"output_tokens,omitempty"`
+	// Dir is the working directory the conversation's commands run in
+	Dir string `json:"dir,omitempty"`
+	// Persona is the built-in persona the conversation was started with
+	Persona string `json:"persona,omitempty"`
+	// ReadOnly keeps the conversation from getting new messages or edits,
+	// e.g. for a cheat sheet
+	ReadOnly bool `json:"read_only,omitempty"`
+	// Notes are the user's own notes about the conversation, never sent to
+	// the model
+	Notes string `json:"notes,omitempty"`
+	// ContextFile is the file the conversation was started with as context,
+	// its contents are in the system prompt
+	ContextFile string `json:"context_file,omitempty"`
+	// Settings are the request settings the conversation uses instead of
+	// the config's, nil when it has none of its own
+	Settings *Settings `json:"settings,omitempty"`
+	// Version counts saves so one gpt-term doesn't overwrite changes
+	// another one made to the same conversation
+	Version int `json:"version,omitempty"`
+
+	// loaded is the file the conversation was read from or last saved as,
+	// to tell whether it changed since
+	loaded []byte
+}
+
+// Settings override how a conversation's requests are sent. Zero values
+// keep the config's.
+type Settings struct {
+	Model       string   `json:"model,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// ConflictError is returned by SaveConversation when the conversation was
+// saved by someone else since it was loaded
+type ConflictError struct {
+	ID string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conversation %s was changed by another gpt-term instance", e.ID)
 }
 
 type Storage struct {
@@ -26,12 +89,11 @@ type Storage struct {
 }
 
 func NewStorage() (*Storage, error) {
-	homeDir, err := os.UserHomeDir()
+	dir, _, err := appdir.Dir()
 	if err != nil {
-		return nil, fmt.Errorf("error getting home directory: %w", err)
+		return nil, err
 	}
-
-	baseDir := filepath.Join(homeDir, ".gpt-term", "conversations")
+	baseDir := filepath.Join(dir, "conversations")
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, fmt.Errorf("error creating storage directory: %w", err)
 	}
@@ -39,14 +101,40 @@ func NewStorage() (*Storage, error) {
 	return &Storage{baseDir: baseDir}, nil
 }
 
-func (s *Storage) SaveConversation(conv *Conversation) error {
-	filename := fmt.Sprintf("%s_%s.convo",
+// ConversationPath returns the absolute path of the file conv is saved to
+func (s *Storage) ConversationPath(conv *Conversation) string {
+	return filepath.Join(s.baseDir, conversationFilename(conv))
+}
+
+func conversationFilename(conv *Conversation) string {
+	return fmt.Sprintf("%s_%s.convo",
 		conv.CreatedAt.Format("2006-01-02T15-04-05"),
 		conv.ID)
+}
 
-	filepath := filepath.Join(s.baseDir, filename)
+// SaveConversation writes conv to disk, or returns a *ConflictError without
+// writing if the file was saved by another instance since conv was loaded.
+// A conversation that hasn't changed since it was loaded isn't written.
+func (s *Storage) SaveConversation(conv *Conversation) error {
+	filename := conversationFilename(conv)
+	filepath := s.ConversationPath(conv)
 
-	data, err := json.MarshalIndent(conv, "", "  ")
+	// Saving it anyway would bump its version over changes another instance
+	// made in the meantime
+	if conv.loaded != nil && unchanged(conv) {
+		return nil
+	}
+
+	if existing, err := os.ReadFile(filepath); err == nil {
+		var onDisk Conversation
+		if err := json.Unmarshal(existing, &onDisk); err == nil && onDisk.Version > conv.Version {
+			return &ConflictError{ID: conv.ID}
+		}
+	}
+
+	saved := *conv
+	saved.Version++
+	data, err := json.MarshalIndent(saved, "", "  ")
 	if err != nil {
 		return fmt.Errorf("error marshaling conversation: %w", err)
 	}
@@ -54,11 +142,48 @@ func (s *Storage) SaveConversation(conv *Conversation) error {
 	if err := os.WriteFile(filepath, data, 0644); err != nil {
 		return fmt.Errorf("error writing conversation file: %w", err)
 	}
+	conv.Version = saved.Version
+	conv.loaded = data
+
+	// The conversation is saved either way, a stale index only means a slower
+	// lookup next time
+	s.indexFile(conv.ID, filename)
 
 	return nil
 }
 
+// unchanged reports whether conv is the same as the file it was loaded from
+func unchanged(conv *Conversation) bool {
+	var loaded Conversation
+	if err := json.Unmarshal(conv.loaded, &loaded); err != nil {
+		return false
+	}
+	before, err := json.Marshal(loaded)
+	if err != nil {
+		return false
+	}
+	after, err := json.Marshal(conv)
+	return err == nil && bytes.Equal(before, after)
+}
+
+// parseConversation reads a conversation file's contents, remembering them
+// so an unchanged conversation isn't saved again
+func parseConversation(data []byte) (Conversation, error) {
+	var conv Conversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return conv, err
+	}
+	conv.loaded = data
+	return conv, nil
+}
+
 func (s *Storage) LoadConversation(id string) (*Conversation, error) {
+	if conv, ok := s.loadIndexed(id); ok {
+		return conv, nil
+	}
+
+	// Not indexed yet, or the index is out of date, so look through the files
+	defer s.RebuildIndex()
 	files, err := os.ReadDir(s.baseDir)
 	if err != nil {
 		return nil, fmt.Errorf("error reading directory: %w", err)
@@ -71,8 +196,8 @@ func (s *Storage) LoadConversation(id string) (*Conversation, error) {
 				continue
 			}
 
-			var conv Conversation
-			if err := json.Unmarshal(data, &conv); err != nil {
+			conv, err := parseConversation(data)
+			if err != nil {
 				continue
 			}
 
@@ -99,8 +224,8 @@ func (s *Storage) ListConversations() ([]Conversation, error) {
 				continue
 			}
 
-			var conv Conversation
-			if err := json.Unmarshal(data, &conv); err != nil {
+			conv, err := parseConversation(data)
+			if err != nil {
 				continue
 			}
 
@@ -111,24 +236,261 @@ func (s *Storage) ListConversations() ([]Conversation, error) {
 	return conversations, nil
 }
 
+// SearchResult is a conversation matching a search, with a snippet of the
+// text around the first match. The match is Snippet[MatchStart:MatchEnd].
+type SearchResult struct {
+	Conversation Conversation
+	Snippet      string
+	MatchStart   int
+	MatchEnd     int
+}
+
+// snippetContext is how many bytes around a match a snippet shows
+const snippetContext = 30
+
+// SearchConversations finds the conversations whose summary or messages
+// contain query, ignoring case
+func (s *Storage) SearchConversations(query string) ([]SearchResult, error) {
+	conversations, err := s.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+
+	queryRe := regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+	var results []SearchResult
+	for _, conv := range conversations {
+		texts := []string{conv.Summary}
+		for _, msg := range conv.Messages {
+			if msg.Role != "system" {
+				texts = append(texts, msg.Content)
+			}
+		}
+
+		for _, text := range texts {
+			// Snippets are a single line
+			text = strings.Join(strings.Fields(text), " ")
+			loc := queryRe.FindStringIndex(text)
+			if loc == nil {
+				continue
+			}
+			results = append(results, snippet(conv, text, loc[0], loc[1]))
+			break
+		}
+	}
+	return results, nil
+}
+
+// snippet cuts the text around a match, keeping whole UTF-8 characters
+func snippet(conv Conversation, text string, start, end int) SearchResult {
+	from := max(0, start-snippetContext)
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	to := min(len(text), end+snippetContext)
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	result := SearchResult{
+		Conversation: conv,
+		Snippet:      text[from:to],
+		MatchStart:   start - from,
+		MatchEnd:     end - from,
+	}
+	if from > 0 {
+		result.Snippet = "…" + result.Snippet
+		result.MatchStart += len("…")
+		result.MatchEnd += len("…")
+	}
+	if to < len(text) {
+		result.Snippet += "…"
+	}
+	return result
+}
+
+// FindConversations finds the conversations whose ID starts with query or,
+// if there are none, whose summary matches it. Summaries containing query
+// match, otherwise ones containing its letters in order, ignoring case.
+// The most recent comes first.
+func (s *Storage) FindConversations(query string) ([]Conversation, error) {
+	conversations, err := s.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+
+	var byID, contains, fuzzy []Conversation
+	lowerQuery := strings.ToLower(query)
+	for _, conv := range conversations {
+		summary := strings.ToLower(conv.Summary)
+		switch {
+		case strings.HasPrefix(conv.ID, lowerQuery):
+			byID = append(byID, conv)
+		case strings.Contains(summary, lowerQuery):
+			contains = append(contains, conv)
+		case fuzzyMatch(summary, lowerQuery):
+			fuzzy = append(fuzzy, conv)
+		}
+	}
+
+	matches := byID
+	if len(matches) == 0 {
+		matches = contains
+	}
+	if len(matches) == 0 {
+		matches = fuzzy
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].CreatedAt.After(matches[j].CreatedAt)
+	})
+	return matches, nil
+}
+
+// fuzzyMatch reports whether the letters of query appear in text in order,
+// ignoring spaces
+func fuzzyMatch(text, query string) bool {
+	query = strings.Join(strings.Fields(query), "")
+	for _, r := range query {
+		i := strings.IndexRune(text, r)
+		if i < 0 {
+			return false
+		}
+		text = text[i+utf8.RuneLen(r):]
+	}
+	return query != ""
+}
+
 func (s *Storage) UpdateConversation(conv *Conversation) error {
 	return s.SaveConversation(conv)
 }
 
+// draftPath is where an unsent prompt is kept between sessions
+func (s *Storage) draftPath() string {
+	return filepath.Join(filepath.Dir(s.baseDir), "draft.txt")
+}
+
+// SaveDraft keeps an unsent prompt so it can be restored on the next start.
+// An empty draft removes the saved one.
+func (s *Storage) SaveDraft(draft string) error {
+	if draft == "" {
+		if err := os.Remove(s.draftPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing draft: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(s.draftPath(), []byte(draft), 0600); err != nil {
+		return fmt.Errorf("error writing draft: %w", err)
+	}
+	return nil
+}
+
+// LoadDraft returns the prompt saved by SaveDraft, if any
+func (s *Storage) LoadDraft() string {
+	data, err := os.ReadFile(s.draftPath())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// SaveAsCopy saves conv under a new ID, e.g. to keep it alongside a version
+// another instance saved. conv is updated so later saves go to the copy.
+func (s *Storage) SaveAsCopy(conv *Conversation) error {
+	conv.ID = uuid.New().String()
+	conv.Version = 0
+	conv.Summary += " (conflict copy)"
+	return s.SaveConversation(conv)
+}
+
+// RenameConversation changes a conversation's summary and saves it
+func (s *Storage) RenameConversation(conv *Conversation, summary string) error {
+	conv.Summary = summary
+	return s.SaveConversation(conv)
+}
+
+// DuplicateConversation saves a copy of a conversation under a new ID so it
+// can be continued without touching the original
+func (s *Storage) DuplicateConversation(id string) (*Conversation, error) {
+	orig, err := s.LoadConversation(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dup := &Conversation{
+		ID:        uuid.New().String(),
+		Messages:  make([]Message, len(orig.Messages)),
+		CreatedAt: time.Now(),
+		Summary:   orig.Summary + " (copy)",
+		Settings:  orig.Settings,
+		// Its contents are in the copied system prompt
+		ContextFile: orig.ContextFile,
+	}
+	copy(dup.Messages, orig.Messages)
+
+	if err := s.SaveConversation(dup); err != nil {
+		return nil, err
+	}
+
+	return dup, nil
+}
+
 func (s *Storage) GenerateConversationSummary(messages []Message) string {
 	if len(messages) == 0 {
 		return "Empty conversation"
 	}
 
-	// Use the first user message as the summary
+	if summary, ok := SubstantiveSummary(messages); ok {
+		return summary
+	}
+	// Only greetings and the like, still better than nothing
 	for _, msg := range messages {
 		if msg.Role == "user" {
-			if len(msg.Content) > 50 {
-				return msg.Content[:47] + "..."
-			}
-			return msg.Content
+			return shortSummary(msg.Content)
 		}
 	}
 
 	return "No user messages"
 }
+
+// SubstantiveSummary uses the first user message that says what the
+// conversation is about as its summary. It returns false if there's none yet,
+// e.g. when the user only said "hi".
+func SubstantiveSummary(messages []Message) (string, bool) {
+	for _, msg := range messages {
+		if msg.Role == "user" && !lowInformation(msg.Content) {
+			return shortSummary(msg.Content), true
+		}
+	}
+	return "", false
+}
+
+// shortSummary cuts text down to the length of a summary
+func shortSummary(text string) string {
+	if len(text) > 50 {
+		return text[:47] + "..."
+	}
+	return text
+}
+
+// fillerWords say nothing about what a conversation is about
+var fillerWords = map[string]bool{
+	"hi": true, "hii": true, "hello": true, "hey": true, "yo": true, "sup": true, "there": true,
+	"good": true, "morning": true, "afternoon": true, "evening": true,
+	"help": true, "me": true, "please": true, "pls": true, "can": true, "could": true, "you": true,
+	"i": true, "need": true, "have": true, "a": true, "question": true, "quick": true,
+	"thanks": true, "thank": true, "ok": true, "okay": true, "test": true, "testing": true,
+	"um": true, "hmm": true, "so": true, "with": true, "something": true,
+}
+
+// lowInformation reports whether a message is only filler like "hi there" or
+// "can you help me?", which makes a useless summary
+func lowInformation(content string) bool {
+	words := strings.FieldsFunc(strings.ToLower(content), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if !fillerWords[word] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSaveConversationUnchanged(t *testing.T) {
+	s := &Storage{baseDir: t.TempDir()}
+	conv := &Conversation{
+		ID:        "test",
+		CreatedAt: time.Now(),
+		Messages:  []Message{{Role: "user", Content: "hi"}},
+	}
+	if err := s.SaveConversation(conv); err != nil {
+		t.Fatalf("SaveConversation: %v", err)
+	}
+
+	// Two instances open the same conversation, the first one changes it
+	first, err := s.LoadConversation("test")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	second, err := s.LoadConversation("test")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	first.Messages = append(first.Messages, Message{Role: "assistant", Content: "hello"})
+	if err := s.SaveConversation(first); err != nil {
+		t.Fatalf("SaveConversation: %v", err)
+	}
+
+	// Saving the second one unchanged isn't a conflict
+	if err := s.SaveConversation(second); err != nil {
+		t.Fatalf("SaveConversation of an unchanged conversation: %v", err)
+	}
+	loaded, err := s.LoadConversation("test")
+	if err != nil {
+		t.Fatalf("LoadConversation: %v", err)
+	}
+	if len(loaded.Messages) != 2 {
+		t.Errorf("got %d messages, want the first instance's 2", len(loaded.Messages))
+	}
+
+	// Changing it is
+	second.Summary = "renamed"
+	var conflict *ConflictError
+	if err := s.SaveConversation(second); !errors.As(err, &conflict) {
+		t.Errorf("err = %v, want a *ConflictError", err)
+	}
+}